@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/pmezard/go-difflib/difflib"
+	config_util "github.com/prometheus/common/config"
+
+	"github.com/ilolicon/demoapp/pkg/client"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// ctlCommand operates running demoapp instances through their HTTP API.
+type ctlCommand struct {
+	urls           []string
+	httpConfigFile string
+	timeout        time.Duration
+	output         string
+	configFile     string
+
+	status       *kingpin.CmdClause
+	reload       *kingpin.CmdClause
+	quit         *kingpin.CmdClause
+	configGet    *kingpin.CmdClause
+	configPut    *kingpin.CmdClause
+	readyFail    *kingpin.CmdClause
+	readyRestore *kingpin.CmdClause
+}
+
+// ctlResult is the outcome of a command on one instance.
+type ctlResult struct {
+	URL    string     `json:"url"`
+	Status *ctlStatus `json:"status,omitempty"`
+	Config string     `json:"config,omitempty"`
+	Diff   string     `json:"diff,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// ctlStatus is the output of the status command.
+type ctlStatus struct {
+	Version    string `json:"version"`
+	Revision   string `json:"revision"`
+	Hostname   string `json:"hostname"`
+	Goroutines int    `json:"goroutines"`
+	Ready      bool   `json:"ready"`
+}
+
+func newCtlCommand(app *kingpin.Application) *ctlCommand {
+	c := &ctlCommand{}
+	cmd := app.Command("ctl", "Operate running demoapp instances through their HTTP API.")
+	cmd.Flag("url", "URL of a demoapp instance. Repeatable for multiple instances.").Default("http://localhost:80").StringsVar(&c.urls)
+	cmd.Flag("http.config.file", "HTTP client configuration file for TLS and basic authentication, in the format of the Prometheus HTTP client configuration.").Default("").StringVar(&c.httpConfigFile)
+	cmd.Flag("timeout", "Maximum duration of the command.").Default("30s").DurationVar(&c.timeout)
+	cmd.Flag("output", "Output format. One of: [table, json]").Short('o').Default(outputTable).EnumVar(&c.output, outputTable, outputJSON)
+
+	c.status = cmd.Command("status", "Show the version, runtime and readiness of the instances.")
+	c.reload = cmd.Command("reload", "Reload the configuration file and show the changes.")
+	c.quit = cmd.Command("quit", "Shut the instances down.")
+	config := cmd.Command("config", "Get or replace the configuration file.")
+	c.configGet = config.Command("get", "Show the loaded configuration.")
+	c.configPut = config.Command("put", "Replace the configuration file and reload it. Requires --web.enable-config-api on the instances.")
+	c.configPut.Arg("file", "Configuration file to send. Read from stdin if omitted.").StringVar(&c.configFile)
+	ready := cmd.Command("ready", "Fail or restore the readiness probe.")
+	c.readyFail = ready.Command("fail", "Fail the readiness probe, e.g. to drain the instances.")
+	c.readyRestore = ready.Command("restore", "Restore the readiness probe.")
+	return c
+}
+
+// handles returns whether the parsed command is a ctl command.
+func (c *ctlCommand) handles(cmd string) bool {
+	return strings.HasPrefix(cmd, "ctl ")
+}
+
+// run executes the ctl command on every instance and returns the exit code.
+func (c *ctlCommand) run(cmd string) int {
+	httpConfig := config_util.DefaultHTTPClientConfig
+	if c.httpConfigFile != "" {
+		cfg, _, err := config_util.LoadHTTPConfigFile(c.httpConfigFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error loading the HTTP client configuration:", err)
+			return 1
+		}
+		httpConfig = *cfg
+	}
+
+	var f func(context.Context, *client.Client) ctlResult
+	switch cmd {
+	case c.status.FullCommand():
+		f = ctlStatusOf
+	case c.reload.FullCommand():
+		f = ctlReload
+	case c.quit.FullCommand():
+		f = ctlAction((*client.Client).Quit)
+	case c.configGet.FullCommand():
+		f = ctlConfigGet
+	case c.configPut.FullCommand():
+		content, err := readConfigFile(c.configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading the configuration file:", err)
+			return 1
+		}
+		f = ctlConfigPut(content)
+	case c.readyFail.FullCommand():
+		f = ctlAction((*client.Client).FailReady)
+	case c.readyRestore.FullCommand():
+		f = ctlAction((*client.Client).RestoreReady)
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown command:", cmd)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	results := runOnInstances(ctx, c.urls, httpConfig, f)
+
+	var err error
+	if c.output == outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(results)
+	} else {
+		err = writeCtlTable(os.Stdout, cmd == c.status.FullCommand(), cmd == c.configGet.FullCommand(), results)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing the output:", err)
+		return 1
+	}
+
+	for _, r := range results {
+		if r.Error != "" {
+			return 1
+		}
+	}
+	return 0
+}
+
+// runOnInstances runs f concurrently on the instance of every URL and returns
+// the results in the order of the URLs.
+func runOnInstances(ctx context.Context, urls []string, httpConfig config_util.HTTPClientConfig, f func(context.Context, *client.Client) ctlResult) []ctlResult {
+	results := make([]ctlResult, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		cfg := client.DefaultConfig
+		cfg.Address = u
+		cfg.HTTPClientConfig = httpConfig
+		cl, err := client.New(cfg)
+		if err != nil {
+			results[i] = ctlResult{URL: u, Error: err.Error()}
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = f(ctx, cl)
+			results[i].URL = u
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+func readConfigFile(name string) ([]byte, error) {
+	if name == "" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
+
+func ctlStatusOf(ctx context.Context, c *client.Client) ctlResult {
+	build, err := c.BuildInfo(ctx)
+	if err != nil {
+		return ctlResult{Error: err.Error()}
+	}
+	runtimeInfo, err := c.RuntimeInfo(ctx)
+	if err != nil {
+		return ctlResult{Error: err.Error()}
+	}
+	ready, err := c.Ready(ctx)
+	if err != nil {
+		return ctlResult{Error: err.Error()}
+	}
+	return ctlResult{Status: &ctlStatus{
+		Version:    build.Version,
+		Revision:   build.Revision,
+		Hostname:   runtimeInfo.Hostname,
+		Goroutines: runtimeInfo.GoroutineCount,
+		Ready:      ready,
+	}}
+}
+
+// ctlAction returns a command calling f without output.
+func ctlAction(f func(*client.Client, context.Context) error) func(context.Context, *client.Client) ctlResult {
+	return func(ctx context.Context, c *client.Client) ctlResult {
+		if err := f(c, ctx); err != nil {
+			return ctlResult{Error: err.Error()}
+		}
+		return ctlResult{}
+	}
+}
+
+func ctlConfigGet(ctx context.Context, c *client.Client) ctlResult {
+	cfg, err := c.Config(ctx)
+	if err != nil {
+		return ctlResult{Error: err.Error()}
+	}
+	return ctlResult{Config: cfg}
+}
+
+// ctlReload reloads the configuration and compares the configurations loaded
+// before and after.
+func ctlReload(ctx context.Context, c *client.Client) ctlResult {
+	return ctlChange(ctx, c, func() (string, error) {
+		if err := c.Reload(ctx); err != nil {
+			return "", err
+		}
+		return c.Config(ctx)
+	})
+}
+
+func ctlConfigPut(content []byte) func(context.Context, *client.Client) ctlResult {
+	return func(ctx context.Context, c *client.Client) ctlResult {
+		return ctlChange(ctx, c, func() (string, error) {
+			return c.PutConfig(ctx, content)
+		})
+	}
+}
+
+// ctlChange applies a configuration change and returns the difference of the
+// loaded configuration.
+func ctlChange(ctx context.Context, c *client.Client, change func() (string, error)) ctlResult {
+	before, err := c.Config(ctx)
+	if err != nil {
+		return ctlResult{Error: err.Error()}
+	}
+	after, err := change()
+	if err != nil {
+		return ctlResult{Error: err.Error()}
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		// SplitLines appends a newline to the last line.
+		A:        difflib.SplitLines(strings.TrimSuffix(before, "\n")),
+		B:        difflib.SplitLines(strings.TrimSuffix(after, "\n")),
+		FromFile: "before",
+		ToFile:   "after",
+		Context:  3,
+	})
+	if err != nil {
+		return ctlResult{Error: err.Error()}
+	}
+	return ctlResult{Diff: diff}
+}
+
+// writeCtlTable writes one row per instance, followed by the configurations
+// or the configuration changes.
+func writeCtlTable(w io.Writer, status, config bool, results []ctlResult) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if status {
+		fmt.Fprintln(tw, "URL\tVERSION\tREVISION\tHOSTNAME\tGOROUTINES\tREADY\tERROR")
+	} else {
+		fmt.Fprintln(tw, "URL\tRESULT")
+	}
+	for _, r := range results {
+		switch {
+		case status && r.Status != nil:
+			s := r.Status
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t\n", r.URL, s.Version, s.Revision, s.Hostname, s.Goroutines, strconv.FormatBool(s.Ready))
+		case status:
+			fmt.Fprintf(tw, "%s\t\t\t\t\t\t%s\n", r.URL, r.Error)
+		case r.Error != "":
+			fmt.Fprintf(tw, "%s\terror: %s\n", r.URL, r.Error)
+		case r.Diff != "":
+			fmt.Fprintf(tw, "%s\tok, configuration changed\n", r.URL)
+		default:
+			fmt.Fprintf(tw, "%s\tok\n", r.URL)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		switch {
+		case config && r.Error == "":
+			fmt.Fprintf(w, "\n# %s\n%s", r.URL, r.Config)
+		case r.Diff != "":
+			fmt.Fprintf(w, "\n# %s\n%s", r.URL, r.Diff)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	config_util "github.com/prometheus/common/config"
+	"github.com/stretchr/testify/require"
+)
+
+// testInstance is a fake demoapp instance serving the endpoints used by the
+// ctl commands.
+type testInstance struct {
+	hostname string
+	ready    bool
+
+	mtx     sync.Mutex
+	config  string
+	reloads []string // Configurations loaded by the next reloads.
+}
+
+func (i *testInstance) start(t *testing.T) string {
+	t.Helper()
+	respond := func(w http.ResponseWriter, data interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "data": data})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/status/buildinfo", func(w http.ResponseWriter, _ *http.Request) {
+		respond(w, map[string]string{"version": "1.0.0", "revision": "abc"})
+	})
+	mux.HandleFunc("GET /api/v1/status/runtimeinfo", func(w http.ResponseWriter, _ *http.Request) {
+		respond(w, map[string]interface{}{"hostname": i.hostname, "goroutineCount": 7})
+	})
+	mux.HandleFunc("GET /api/v1/status/config", func(w http.ResponseWriter, _ *http.Request) {
+		i.mtx.Lock()
+		defer i.mtx.Unlock()
+		respond(w, map[string]string{"yaml": i.config})
+	})
+	mux.HandleFunc("GET /-/ready", func(w http.ResponseWriter, _ *http.Request) {
+		if !i.ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	mux.HandleFunc("POST /-/reload", func(w http.ResponseWriter, _ *http.Request) {
+		i.mtx.Lock()
+		defer i.mtx.Unlock()
+		if len(i.reloads) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "Lifecycle API is not enabled.")
+			return
+		}
+		i.config, i.reloads = i.reloads[0], i.reloads[1:]
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestCtlStatus(t *testing.T) {
+	first := (&testInstance{hostname: "first", ready: true}).start(t)
+	second := (&testInstance{hostname: "second"}).start(t)
+	urls := []string{first, second, "ftp://invalid"}
+
+	results := runOnInstances(context.Background(), urls, config_util.DefaultHTTPClientConfig, ctlStatusOf)
+	require.Len(t, results, 3)
+	require.Equal(t, ctlResult{URL: first, Status: &ctlStatus{Version: "1.0.0", Revision: "abc", Hostname: "first", Goroutines: 7, Ready: true}}, results[0])
+	require.Equal(t, ctlResult{URL: second, Status: &ctlStatus{Version: "1.0.0", Revision: "abc", Hostname: "second", Goroutines: 7}}, results[1])
+	require.Equal(t, "ftp://invalid", results[2].URL)
+	require.Contains(t, results[2].Error, "scheme must be http or https")
+
+	var buf bytes.Buffer
+	require.NoError(t, writeCtlTable(&buf, true, false, results))
+	url := column(urls)
+	require.Equal(t, url("URL")+"  VERSION  REVISION  HOSTNAME  GOROUTINES  READY  ERROR\n"+
+		url(first)+"  1.0.0    abc       first     7           true   \n"+
+		url(second)+"  1.0.0    abc       second    7           false  \n"+
+		url("ftp://invalid")+"                                                  invalid address \"ftp://invalid\": scheme must be http or https\n",
+		buf.String())
+}
+
+func TestCtlReload(t *testing.T) {
+	changed := (&testInstance{config: "date_format: a\n", reloads: []string{"date_format: b\n"}}).start(t)
+	unchanged := (&testInstance{config: "date_format: a\n", reloads: []string{"date_format: a\n"}}).start(t)
+	forbidden := (&testInstance{config: "date_format: a\n"}).start(t)
+	urls := []string{changed, unchanged, forbidden}
+
+	results := runOnInstances(context.Background(), urls, config_util.DefaultHTTPClientConfig, ctlReload)
+	require.Len(t, results, 3)
+	diff := "--- before\n+++ after\n@@ -1 +1 @@\n-date_format: a\n+date_format: b\n"
+	require.Equal(t, ctlResult{URL: changed, Diff: diff}, results[0])
+	require.Equal(t, ctlResult{URL: unchanged}, results[1])
+	require.Equal(t, forbidden, results[2].URL)
+	require.Contains(t, results[2].Error, "Lifecycle API is not enabled.")
+
+	var buf bytes.Buffer
+	require.NoError(t, writeCtlTable(&buf, false, false, results))
+	url := column(urls)
+	require.Equal(t, url("URL")+"  RESULT\n"+
+		url(changed)+"  ok, configuration changed\n"+
+		url(unchanged)+"  ok\n"+
+		url(forbidden)+"  error: "+results[2].Error+"\n"+
+		"\n# "+changed+"\n"+diff,
+		buf.String())
+}
+
+func TestCtlConfigGet(t *testing.T) {
+	first := (&testInstance{config: "date_format: a\n"}).start(t)
+	second := (&testInstance{config: "date_format: b\n"}).start(t)
+	urls := []string{first, second}
+
+	results := runOnInstances(context.Background(), urls, config_util.DefaultHTTPClientConfig, ctlConfigGet)
+	require.Equal(t, []ctlResult{{URL: first, Config: "date_format: a\n"}, {URL: second, Config: "date_format: b\n"}}, results)
+
+	var buf bytes.Buffer
+	require.NoError(t, writeCtlTable(&buf, false, true, results))
+	url := column(urls)
+	require.Equal(t, url("URL")+"  RESULT\n"+
+		url(first)+"  ok\n"+
+		url(second)+"  ok\n"+
+		"\n# "+first+"\ndate_format: a\n"+
+		"\n# "+second+"\ndate_format: b\n",
+		buf.String())
+}
+
+// column returns a function padding a cell to the width of the URL column of
+// the table.
+func column(urls []string) func(string) string {
+	width := len("URL")
+	for _, u := range urls {
+		width = max(width, len(u))
+	}
+	return func(s string) string {
+		return s + strings.Repeat(" ", width-len(s))
+	}
+}
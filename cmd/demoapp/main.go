@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
 	"runtime"
@@ -20,6 +22,12 @@ import (
 	webflag "github.com/prometheus/exporter-toolkit/web/kingpinflag"
 
 	"github.com/ilolicon/demoapp/config"
+	"github.com/ilolicon/demoapp/l4echo"
+	"github.com/ilolicon/demoapp/tracing"
+	"github.com/ilolicon/demoapp/util/clientip"
+	"github.com/ilolicon/demoapp/util/loglevel"
+	"github.com/ilolicon/demoapp/util/netconnlimit"
+	"github.com/ilolicon/demoapp/util/netlisten"
 	"github.com/ilolicon/demoapp/web"
 )
 
@@ -30,7 +38,7 @@ func init() {
 
 func main() {
 	if os.Getenv("DEBUG") != "" {
-		runtime.SetBlockProfileRate(20)
+		web.SetBlockProfileRate(20)
 		runtime.SetMutexProfileFraction(20)
 	}
 
@@ -38,18 +46,49 @@ func main() {
 		configFile      = kingpin.Flag("config.file", "Demoapp configuration file name.").Default("config.yaml").String()
 		webConfig       = webflag.AddFlags(kingpin.CommandLine, ":80")
 		readTimeout     = kingpin.Flag("web.read-timeout", "Maximum duration before timing out read of the request, and closing idle connections.").Default("5m").Duration()
-		maxConnections  = kingpin.Flag("web.max-connections", "Maximum number of concurrent connections.").Default("512").Int()
+		readHdrTimeout  = kingpin.Flag("web.read-header-timeout", "Maximum duration before timing out read of the request headers. 0 uses --web.read-timeout.").Default("0s").Duration()
+		writeTimeout    = kingpin.Flag("web.write-timeout", "Maximum duration before timing out writes of the response. 0 disables the timeout.").Default("0s").Duration()
+		idleTimeout     = kingpin.Flag("web.idle-timeout", "Maximum duration to wait for the next request on keep-alive connections. 0 uses --web.read-timeout.").Default("0s").Duration()
+		maxConnections  = kingpin.Flag("web.max-connections", "Maximum number of concurrent connections, unless set by connections.max_connections in the configuration file.").Default("512").Int()
+		maxConnsPerIP   = kingpin.Flag("web.max-connections-per-ip", "Maximum number of concurrent connections from a single client IP address. 0 disables the limit.").Default("0").Int()
+		connAcquireWait = kingpin.Flag("web.connection-acquire-timeout", "Maximum duration a new connection waits for a free slot when --web.max-connections is reached. 0 waits indefinitely. At most --web.max-connections connections wait at a time, further ones stay in the listen backlog.").Default("0s").Duration()
+		connRejectMode  = kingpin.Flag("web.connection-reject-mode", "How connections over the limits are turned away. One of: [close, 503]").Default(string(netconnlimit.RejectClose)).Enum(netconnlimit.RejectModes...)
+		adminAddresses  = kingpin.Flag("web.admin-listen-address", "Addresses on which to expose the lifecycle, metrics, status API and debug endpoints instead of the web listen addresses. Repeatable for multiple addresses. Not supported with systemd socket activation.").Strings()
+		adminWebConfig  = kingpin.Flag("web.admin-config.file", "Path to configuration file that can enable TLS or authentication on the admin listeners.").Default("").String()
+		shutdownTimeout = kingpin.Flag("web.shutdown-timeout", "Maximum duration to wait for in-flight requests when shutting down.").Default("30s").Duration()
+		upgradeTimeout  = kingpin.Flag("web.upgrade-timeout", "Maximum duration to wait for the new process to be ready during a binary upgrade (SIGUSR2). Under systemd, upgrades require NotifyAccess=all in the service unit.").Default("1m").Duration()
+		adminMaxConns   = kingpin.Flag("web.admin-max-connections", "Maximum number of concurrent connections on the admin listeners.").Default("64").Int()
 		enableLifecycle = kingpin.Flag("web.enable-lifecycle", "Enable shutdown and relaod via HTTP request.").Default("true").Bool()
+		enableConfigAPI = kingpin.Flag("web.enable-config-api", "Enable replacing the configuration file via PUT /api/v1/status/config. Any client of the listeners serving the API can then rewrite the configuration file.").Default("false").Bool()
+		enableDebug     = kingpin.Flag("web.enable-debug", "Enable the pprof, expvar and goroutine dump endpoints under /debug. Requires the lifecycle API, which is enabled by default: any client of the listeners serving them can then profile the process and change its profile rates.").Default("false").Bool()
+		tcpEchoAddress  = kingpin.Flag("tcp.echo-address", "Address on which to expose the raw TCP echo server. Disabled if empty.").Default("").String()
+		tcpEchoMaxConns = kingpin.Flag("tcp.echo-max-connections", "Maximum number of concurrent TCP echo connections.").Default("512").Int()
+		tcpEchoIdle     = kingpin.Flag("tcp.echo-idle-timeout", "Duration after which idle TCP echo connections are closed. 0 disables the timeout.").Default("5m").Duration()
+		udpEchoAddress  = kingpin.Flag("udp.echo-address", "Address on which to expose the UDP echo server. Disabled if empty.").Default("").String()
+		proxyProtocol   = kingpin.Flag("web.proxy-protocol", "Parse PROXY protocol v1 and v2 headers on the web listeners. Requires --web.proxy-protocol-trusted-cidr.").Default("false").Bool()
+		proxyTrusted    = kingpin.Flag("web.proxy-protocol-trusted-cidr", "CIDR range of the load balancers allowed to send PROXY protocol headers. Connections from other peers sending a header are closed. Repeatable for multiple ranges.").Strings()
+		proxyTimeout    = kingpin.Flag("web.proxy-protocol-header-timeout", "Maximum duration to wait for the PROXY protocol header of a new connection.").Default("10s").Duration()
+		h2cMode         = kingpin.Flag("web.h2c", "Serve HTTP/2 over cleartext TCP on the web listeners. One of: [off, prior-knowledge, upgrade, all]").Default(string(web.H2COff)).Enum(web.H2CModes...)
 	)
 
+	kingpin.Command("serve", "Run the demoapp server. This is the default command.").Default()
+	ctl := newCtlCommand(kingpin.CommandLine)
+
 	promslogConfig := &promslog.Config{}
 	flag.AddFlags(kingpin.CommandLine, promslogConfig)
 	kingpin.Version(version.Print("demoapp"))
 	kingpin.CommandLine.UsageWriter(os.Stdout) // 帮助文档输出到标准输出(default: 标准错误输出)
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	if cmd := kingpin.Parse(); ctl.handles(cmd) {
+		os.Exit(ctl.run(cmd))
+	}
 
-	logger := promslog.New(promslogConfig)
+	logLevels, err := loglevel.New(promslogConfig.Level.String())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	logger := slog.New(logLevels.Handler(tracing.NewLogHandler(promslog.New(promslogConfig).Handler())))
 	logger.Info("Starting demoapp", "version", version.Info())
 	logger.Info("Build context", "build_context", version.BuildContext())
 
@@ -67,6 +106,18 @@ func main() {
 		flagsMap[f.Name] = f.Value.String()
 	}
 
+	proxyTrustedCIDRs, err := clientip.ParsePrefixes(*proxyTrusted)
+	if err != nil {
+		logger.Error("Invalid PROXY protocol trusted CIDR", "err", err)
+		os.Exit(1)
+	}
+
+	listenerSource, err := netlisten.NewSource(*webConfig.WebSystemdSocket)
+	if err != nil {
+		logger.Error("Unable to inherit listeners", "err", err)
+		os.Exit(1)
+	}
+
 	webHandler := web.New(logger.With("component", "web"), &web.Options{
 		Version: &web.DemoappVersion{
 			Version:   version.Version,
@@ -81,8 +132,30 @@ func main() {
 		ListenAddresses: *webConfig.WebListenAddresses,
 		ReadTimeout:     *readTimeout,
 		MaxConnections:  *maxConnections,
+
+		ReadHeaderTimeout: *readHdrTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+
+		MaxConnectionsPerIP:      *maxConnsPerIP,
+		ConnectionAcquireTimeout: *connAcquireWait,
+		ConnectionRejectMode:     netconnlimit.RejectMode(*connRejectMode),
+
+		AdminListenAddresses: *adminAddresses,
+		AdminMaxConnections:  *adminMaxConns,
+		ListenerSource:       listenerSource,
+		ShutdownTimeout:      *shutdownTimeout,
+
+		ProxyProtocol:              *proxyProtocol,
+		ProxyProtocolTrustedCIDRs:  proxyTrustedCIDRs,
+		ProxyProtocolHeaderTimeout: *proxyTimeout,
+
 		EnableLifecycle: *enableLifecycle,
+		EnableConfigAPI: *enableConfigAPI,
+		EnableDebug:     *enableDebug,
+		H2C:             web.H2CMode(*h2cMode),
 		AppName:         "demoapp",
+		LogLevels:       logLevels,
 
 		Gatherer:   prometheus.DefaultGatherer,
 		Registerer: prometheus.DefaultRegisterer,
@@ -108,12 +181,39 @@ func main() {
 		logger.Error("Unable to start web listener", "err", err)
 		os.Exit(1)
 	}
+	adminListeners, err := webHandler.AdminListeners()
+	if err != nil {
+		logger.Error("Unable to start admin listener", "err", err)
+		os.Exit(1)
+	}
+
+	var tcpEchoListener net.Listener
+	if *tcpEchoAddress != "" {
+		tcpEchoListener, err = listenerSource.Listen(*tcpEchoAddress)
+		if err != nil {
+			logger.Error("Unable to start TCP echo listener", "err", err)
+			os.Exit(1)
+		}
+		tcpEchoListener = l4echo.LimitListener(tcpEchoListener, netconnlimit.NewSharedSemaphore(*tcpEchoMaxConns))
+	}
+	var udpEchoConn net.PacketConn
+	if *udpEchoAddress != "" {
+		udpEchoConn, err = listenerSource.ListenPacket(*udpEchoAddress)
+		if err != nil {
+			logger.Error("Unable to start UDP echo listener", "err", err)
+			os.Exit(1)
+		}
+	}
+	// Inherited sockets which are not listened on anymore.
+	listenerSource.CloseUnused()
+
+	tracingManager := tracing.NewManager(logger.With("component", "tracing"), version.Version)
 
 	configLogger := logger.With("component", "configuration")
 	configCoordinator := config.NewCoordinator(*configFile, prometheus.DefaultRegisterer, configLogger)
 	configCoordinator.Subscribe(func(conf *config.Config) error {
 		return webHandler.ApplyConfig(conf)
-	})
+	}, tracingManager.ApplyConfig)
 
 	ctxWeb, cancelWeb := context.WithCancel(context.Background())
 	defer cancelWeb()
@@ -164,6 +264,8 @@ func main() {
 						} else {
 							rc <- nil
 						}
+					case u := <-webHandler.ConfigUpdates():
+						u.Err <- configCoordinator.Replace(u.Content)
 					case <-cancel:
 						return nil
 					}
@@ -174,11 +276,67 @@ func main() {
 			},
 		)
 	}
+	{
+		// Log level toggle handler.
+		usr1 := make(chan os.Signal, 1)
+		signal.Notify(usr1, syscall.SIGUSR1)
+		cancel := make(chan struct{})
+		g.Add(
+			func() error {
+				logLevels.ToggleOnSignal(usr1, cancel, logger)
+				return nil
+			},
+			func(_ error) {
+				close(cancel)
+			},
+		)
+	}
+	{
+		// Binary upgrade handler.
+		usr2 := make(chan os.Signal, 1)
+		signal.Notify(usr2, syscall.SIGUSR2)
+		cancel := make(chan struct{})
+		g.Add(
+			func() error {
+				for {
+					select {
+					case <-usr2:
+						logger.Info("Received SIGUSR2, starting new process...")
+						p, err := listenerSource.Upgrade(*upgradeTimeout)
+						if err != nil {
+							logger.Error("Binary upgrade failed", "err", err)
+							continue
+						}
+						logger.Warn("Handed listeners over to new process, exiting gracefully...", "pid", p.Pid)
+						return nil
+					case <-cancel:
+						return nil
+					}
+				}
+			},
+			func(_ error) {
+				close(cancel)
+			},
+		)
+	}
+	{
+		// Tracing manager.
+		g.Add(
+			func() error {
+				<-reloadReady.C
+				tracingManager.Run()
+				return nil
+			},
+			func(_ error) {
+				tracingManager.Stop()
+			},
+		)
+	}
 	{
 		// Web handler.
 		g.Add(
 			func() error {
-				if err := webHandler.Run(ctxWeb, listeners, *webConfig.WebConfigFile); err != nil {
+				if err := webHandler.Run(ctxWeb, listeners, adminListeners, *webConfig.WebConfigFile, *adminWebConfig); err != nil {
 					return fmt.Errorf("error starting web server: %w", err)
 				}
 				return nil
@@ -188,6 +346,38 @@ func main() {
 			},
 		)
 	}
+	if tcpEchoListener != nil {
+		// TCP echo server.
+		ctx, cancel := context.WithCancel(context.Background())
+		srv := l4echo.NewTCPServer(logger.With("component", "tcp_echo"), tcpEchoListener, l4echo.Banner("demoapp", version.Info()), *tcpEchoIdle)
+		g.Add(
+			func() error {
+				if err := srv.Run(ctx); err != nil {
+					return fmt.Errorf("error starting TCP echo server: %w", err)
+				}
+				return nil
+			},
+			func(_ error) {
+				cancel()
+			},
+		)
+	}
+	if udpEchoConn != nil {
+		// UDP echo server.
+		ctx, cancel := context.WithCancel(context.Background())
+		srv := l4echo.NewUDPServer(logger.With("component", "udp_echo"), udpEchoConn, l4echo.Banner("demoapp", version.Info()))
+		g.Add(
+			func() error {
+				if err := srv.Run(ctx); err != nil {
+					return fmt.Errorf("error starting UDP echo server: %w", err)
+				}
+				return nil
+			},
+			func(_ error) {
+				cancel()
+			},
+		)
+	}
 	{
 		// Initial configuration loading.
 		cancel := make(chan struct{})
@@ -203,6 +393,9 @@ func main() {
 					}
 					reloadReady.Close()
 					webHandler.SetReady(web.Ready)
+					if err := listenerSource.NotifyReady(); err != nil {
+						logger.Error("Unable to notify the parent process", "err", err)
+					}
 					<-cancel
 					return nil
 				}
@@ -1,31 +1,145 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
+	commoncfg "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
 	"gopkg.in/yaml.v3"
+
+	"github.com/ilolicon/demoapp/util/clientip"
+)
+
+// CallMode defines how the downstreams of a topology route are called.
+type CallMode string
+
+const (
+	CallModeSerial   CallMode = "serial"
+	CallModeParallel CallMode = "parallel"
+)
+
+// TracingClientType defines where spans are exported to.
+type TracingClientType string
+
+const (
+	TracingClientGRPC   TracingClientType = "grpc"
+	TracingClientHTTP   TracingClientType = "http"
+	TracingClientStdout TracingClientType = "stdout"
+	TracingClientFile   TracingClientType = "file"
+
+	TracingCompressionGzip = "gzip"
+)
+
+var (
+	// DefaultTopologyRoute is the default topology route configuration.
+	DefaultTopologyRoute = TopologyRoute{
+		Mode:    CallModeSerial,
+		Timeout: model.Duration(10 * time.Second),
+	}
+
+	// DefaultDownstream is the default downstream configuration.
+	DefaultDownstream = Downstream{
+		Timeout: model.Duration(5 * time.Second),
+	}
+
+	// DefaultConfig is the default top-level configuration.
+	DefaultConfig = Config{
+		AccessLog:    DefaultAccessLogConfig,
+		Tracing:      DefaultTracingConfig,
+		LoadShedding: DefaultLoadSheddingConfig,
+	}
+
+	// DefaultLoadSheddingConfig is the default load shedding configuration.
+	DefaultLoadSheddingConfig = LoadSheddingConfig{
+		TargetLatency: model.Duration(200 * time.Millisecond),
+		InitialLimit:  100,
+		MinLimit:      10,
+		MaxLimit:      1000,
+		BackoffRatio:  0.9,
+	}
+
+	// DefaultAccessLogConfig is the default access log configuration.
+	DefaultAccessLogConfig = AccessLogConfig{
+		Enabled:  true,
+		Format:   "logfmt",
+		Rotation: DefaultAccessLogRotation,
+	}
+
+	// DefaultAccessLogRotation is the default rotation of the access log file.
+	DefaultAccessLogRotation = AccessLogRotation{
+		MaxSizeMB: 100,
+	}
+
+	// DefaultTracingConfig is the default tracing configuration.
+	DefaultTracingConfig = TracingConfig{
+		ClientType:       TracingClientGRPC,
+		SamplingFraction: 1,
+		Timeout:          model.Duration(10 * time.Second),
+	}
 )
 
 type Config struct {
-	DateFormat string `yaml:"date_format"`
+	DateFormat string          `yaml:"date_format"`
+	AccessLog  AccessLogConfig `yaml:"access_log"`
+	Topology   TopologyConfig  `yaml:"topology,omitempty"`
+	Tracing    TracingConfig   `yaml:"tracing,omitempty"`
+	// TrustedProxies are the CIDR ranges of the reverse proxies allowed to
+	// set the client address in the Forwarded, X-Forwarded-For and
+	// X-Real-IP headers.
+	TrustedProxies []string           `yaml:"trusted_proxies,omitempty"`
+	Connections    ConnectionsConfig  `yaml:"connections,omitempty"`
+	RateLimits     RateLimitsConfig   `yaml:"rate_limits,omitempty"`
+	LoadShedding   LoadSheddingConfig `yaml:"load_shedding,omitempty"`
+	Timeouts       TimeoutsConfig     `yaml:"request_timeouts,omitempty"`
 
 	original string
 }
 
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultConfig
+	type plain Config
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if _, err := clientip.ParsePrefixes(c.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted_proxies: %w", err)
+	}
+	return nil
+}
+
+// Load parses the YAML input s into a Config.
+func Load(s string) (*Config, error) {
+	cfg := &Config{}
+	// Set default config
+	*cfg = DefaultConfig
+	if err := yaml.Unmarshal([]byte(s), cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
 func LoadFile(filename string) (*Config, error) {
 	content, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	cfg := &Config{}
-	// Set default config
-	// *cfg = DefaultConfig
-	if err := yaml.Unmarshal(content, cfg); err != nil {
+	cfg, err := Load(string(content))
+	if err != nil {
 		return nil, err
 	}
 
+	cfg.Tracing.SetDirectory(filepath.Dir(filename))
 	cfg.original = filename
 
 	return cfg, nil
@@ -38,3 +152,483 @@ func (c Config) String() string {
 	}
 	return string(b)
 }
+
+// ConnectionsConfig configures the connections of the web listeners.
+type ConnectionsConfig struct {
+	// MaxConnections is the maximum number of concurrent connections. It is
+	// applied on reload without dropping existing connections. The
+	// --web.max-connections flag is used if it is 0.
+	MaxConnections int                `yaml:"max_connections,omitempty"`
+	Reserved       ReservedSlotConfig `yaml:"reserved,omitempty"`
+	// MaxAge is the lifetime after which connections are closed once the
+	// current request completes. HTTP/2 connections are shut down with a
+	// GOAWAY frame.
+	MaxAge model.Duration `yaml:"max_age,omitempty"`
+	// MaxRequests is the number of requests after which a keep-alive
+	// connection is closed.
+	MaxRequests int `yaml:"max_requests,omitempty"`
+	// DisableKeepAlives closes every connection after its first request.
+	DisableKeepAlives bool `yaml:"disable_keep_alives,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *ConnectionsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ConnectionsConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.MaxConnections < 0 {
+		return fmt.Errorf("max_connections must not be negative, got %d", c.MaxConnections)
+	}
+	if c.MaxRequests < 0 {
+		return fmt.Errorf("max_requests must not be negative, got %d", c.MaxRequests)
+	}
+	return nil
+}
+
+// ReservedSlotConfig configures the connection slots kept for priority
+// traffic, e.g. health probes, when max_connections is reached.
+type ReservedSlotConfig struct {
+	Slots int `yaml:"slots,omitempty"`
+	// SourceCIDRs are the client address ranges allowed to use the slots.
+	SourceCIDRs []string `yaml:"source_cidrs,omitempty"`
+	// Ports are the local ports on which connections can use the slots.
+	Ports []int `yaml:"ports,omitempty"`
+	// Paths are path.Match patterns of the first request of connections
+	// allowed to use the slots.
+	Paths []string `yaml:"paths,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *ReservedSlotConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ReservedSlotConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.Slots < 0 {
+		return fmt.Errorf("reserved slots must not be negative, got %d", c.Slots)
+	}
+	if c.Slots > 0 && len(c.SourceCIDRs) == 0 && len(c.Ports) == 0 && len(c.Paths) == 0 {
+		return errors.New("reserved slots require source_cidrs, ports or paths")
+	}
+	if _, err := clientip.ParsePrefixes(c.SourceCIDRs); err != nil {
+		return fmt.Errorf("invalid reserved source_cidrs: %w", err)
+	}
+	for _, port := range c.Ports {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid reserved port %d", port)
+		}
+	}
+	for _, p := range c.Paths {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid reserved path %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// RateLimitsConfig configures the token bucket rate limits of the HTTP
+// endpoints. A request is answered with 429 if any of the limits applying to
+// it is exceeded.
+type RateLimitsConfig struct {
+	// Global limits all requests together.
+	Global *RateLimit `yaml:"global,omitempty"`
+	// PerClient limits the requests of each client IP address. Up to 10000
+	// clients are tracked, the least recently seen one is forgotten first.
+	PerClient *RateLimit `yaml:"per_client,omitempty"`
+	// Routes limit the requests of the given handlers.
+	Routes []*RouteRateLimit `yaml:"routes,omitempty"`
+}
+
+// RateLimit is a token bucket refilled with Rate tokens per second, holding
+// up to Burst tokens. Burst defaults to the rate rounded up.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst,omitempty"`
+}
+
+// RouteRateLimit is the rate limit of a handler, as named by the handler
+// label of the demoapp_http_requests_total metric.
+type RouteRateLimit struct {
+	Handler   string `yaml:"handler"`
+	RateLimit `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *RateLimitsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RateLimitsConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if err := c.Global.validate(); err != nil {
+		return fmt.Errorf("invalid global rate limit: %w", err)
+	}
+	if err := c.PerClient.validate(); err != nil {
+		return fmt.Errorf("invalid per_client rate limit: %w", err)
+	}
+	handlers := map[string]struct{}{}
+	for _, r := range c.Routes {
+		if r == nil {
+			return errors.New("empty route rate limit")
+		}
+		if r.Handler == "" {
+			return errors.New("route rate limit requires a handler")
+		}
+		if _, ok := handlers[r.Handler]; ok {
+			return fmt.Errorf("duplicate rate limit for handler %q", r.Handler)
+		}
+		handlers[r.Handler] = struct{}{}
+		if err := r.RateLimit.validate(); err != nil {
+			return fmt.Errorf("invalid rate limit for handler %q: %w", r.Handler, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the limit and sets the default burst.
+func (l *RateLimit) validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.Rate <= 0 {
+		return fmt.Errorf("rate must be positive, got %v", l.Rate)
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("burst must not be negative, got %d", l.Burst)
+	}
+	if l.Burst == 0 {
+		l.Burst = int(math.Ceil(l.Rate))
+	}
+	return nil
+}
+
+// TimeoutsConfig configures the deadlines of the requests. Requests exceeding
+// their deadline are answered with 503 and the timeout error type. Responses
+// are buffered until the handler returns, handlers keep running after the
+// deadline until they notice the canceled request context.
+type TimeoutsConfig struct {
+	// Default applies to the handlers without a route timeout, except the
+	// lifecycle, metrics and debug endpoints. 0 disables it.
+	Default model.Duration `yaml:"default,omitempty"`
+	// Routes are the timeouts of the given handlers, as named by the handler
+	// label of the demoapp_http_requests_total metric. A timeout of 0
+	// disables the default timeout for the handler.
+	Routes []*RouteTimeout `yaml:"routes,omitempty"`
+}
+
+// RouteTimeout is the timeout of a handler.
+type RouteTimeout struct {
+	Handler string         `yaml:"handler"`
+	Timeout model.Duration `yaml:"timeout"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *TimeoutsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TimeoutsConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	handlers := map[string]struct{}{}
+	for _, r := range c.Routes {
+		if r == nil {
+			return errors.New("empty route timeout")
+		}
+		if r.Handler == "" {
+			return errors.New("route timeout requires a handler")
+		}
+		if _, ok := handlers[r.Handler]; ok {
+			return fmt.Errorf("duplicate timeout for handler %q", r.Handler)
+		}
+		handlers[r.Handler] = struct{}{}
+	}
+	return nil
+}
+
+// LoadSheddingConfig configures the adaptive concurrency limit of the web
+// endpoints. The limit of in-flight requests is increased additively while
+// requests complete within the target latency and decreased multiplicatively
+// otherwise. Requests over the limit are answered with 503. The probes,
+// metrics and debug endpoints are not limited.
+type LoadSheddingConfig struct {
+	Enabled       bool           `yaml:"enabled"`
+	TargetLatency model.Duration `yaml:"target_latency,omitempty"`
+	InitialLimit  int            `yaml:"initial_limit,omitempty"`
+	MinLimit      int            `yaml:"min_limit,omitempty"`
+	MaxLimit      int            `yaml:"max_limit,omitempty"`
+	// BackoffRatio is the factor applied to the limit when the latency
+	// exceeds the target.
+	BackoffRatio float64 `yaml:"backoff_ratio,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *LoadSheddingConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultLoadSheddingConfig
+	type plain LoadSheddingConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	if c.TargetLatency <= 0 {
+		return errors.New("load shedding target_latency must be positive")
+	}
+	if c.MinLimit <= 0 {
+		return fmt.Errorf("load shedding min_limit must be positive, got %d", c.MinLimit)
+	}
+	if c.MaxLimit < c.MinLimit {
+		return fmt.Errorf("load shedding max_limit %d is lower than min_limit %d", c.MaxLimit, c.MinLimit)
+	}
+	if c.InitialLimit < c.MinLimit || c.InitialLimit > c.MaxLimit {
+		return fmt.Errorf("load shedding initial_limit %d must be between min_limit and max_limit", c.InitialLimit)
+	}
+	if c.BackoffRatio <= 0 || c.BackoffRatio >= 1 {
+		return fmt.Errorf("load shedding backoff_ratio must be between 0 and 1, got %v", c.BackoffRatio)
+	}
+	return nil
+}
+
+// AccessLogConfig configures the access log of the HTTP server.
+type AccessLogConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Format  string `yaml:"format,omitempty"`
+	// ExcludePaths are path.Match patterns of request paths not to log.
+	ExcludePaths []string `yaml:"exclude_paths,omitempty"`
+	// File is the path of the access log file, the log goes to stderr if empty.
+	File     string            `yaml:"file,omitempty"`
+	Rotation AccessLogRotation `yaml:"rotation,omitempty"`
+	// SuccessSampling logs only 1 in N successful requests. Requests failing
+	// with a status code of 400 or more are always logged.
+	SuccessSampling int `yaml:"success_sampling,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *AccessLogConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultAccessLogConfig
+	type plain AccessLogConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	switch c.Format {
+	case "json", "logfmt", "combined":
+	default:
+		return fmt.Errorf("unknown access log format %q", c.Format)
+	}
+	for _, p := range c.ExcludePaths {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid access log exclude path %q: %w", p, err)
+		}
+	}
+	if c.SuccessSampling < 0 {
+		return fmt.Errorf("access log success sampling must not be negative, got %d", c.SuccessSampling)
+	}
+	return nil
+}
+
+// AccessLogRotation configures the rotation of the access log file.
+type AccessLogRotation struct {
+	// MaxSizeMB is the size in megabytes at which the file is rotated.
+	MaxSizeMB int `yaml:"max_size_mb,omitempty"`
+	// MaxAge is the age at which the file is rotated regardless of its size.
+	MaxAge model.Duration `yaml:"max_age,omitempty"`
+	// MaxBackups is the number of rotated files to keep, 0 keeps all of them.
+	MaxBackups int `yaml:"max_backups,omitempty"`
+	// Retention is how long rotated files are kept, 0 keeps them forever.
+	Retention model.Duration `yaml:"retention,omitempty"`
+	// Compress enables gzip compression of the rotated files.
+	Compress bool `yaml:"compress,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (r *AccessLogRotation) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*r = DefaultAccessLogRotation
+	type plain AccessLogRotation
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+
+	if r.MaxSizeMB <= 0 {
+		return fmt.Errorf("access log max_size_mb must be positive, got %d", r.MaxSizeMB)
+	}
+	if r.MaxBackups < 0 {
+		return fmt.Errorf("access log max_backups must not be negative, got %d", r.MaxBackups)
+	}
+	return nil
+}
+
+// Excluded returns whether requests to the given path must not be logged.
+func (c *AccessLogConfig) Excluded(p string) bool {
+	for _, pattern := range c.ExcludePaths {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// TopologyConfig configures the downstream services called by each route of
+// the topology endpoint.
+type TopologyConfig struct {
+	Routes []*TopologyRoute `yaml:"routes,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *TopologyConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TopologyConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	paths := map[string]struct{}{}
+	for _, r := range c.Routes {
+		if r == nil {
+			return errors.New("empty or null topology route")
+		}
+		if _, ok := paths[r.Path]; ok {
+			return fmt.Errorf("found multiple topology routes with path %q", r.Path)
+		}
+		paths[r.Path] = struct{}{}
+	}
+	return nil
+}
+
+// Route returns the route configured for the given path, or nil.
+func (c *TopologyConfig) Route(path string) *TopologyRoute {
+	for _, r := range c.Routes {
+		if r.Path == path {
+			return r
+		}
+	}
+	return nil
+}
+
+// TopologyRoute lists the downstreams called when the route is requested.
+type TopologyRoute struct {
+	Path        string         `yaml:"path"`
+	Mode        CallMode       `yaml:"mode,omitempty"`
+	Timeout     model.Duration `yaml:"timeout,omitempty"`
+	Downstreams []*Downstream  `yaml:"downstreams,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (r *TopologyRoute) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*r = DefaultTopologyRoute
+	type plain TopologyRoute
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("topology route path %q must start with '/'", r.Path)
+	}
+	switch r.Mode {
+	case CallModeSerial, CallModeParallel:
+	default:
+		return fmt.Errorf("unknown call mode %q for topology route %q", r.Mode, r.Path)
+	}
+	if r.Timeout <= 0 {
+		return fmt.Errorf("timeout of topology route %q must be positive, got %s", r.Path, r.Timeout)
+	}
+	for _, d := range r.Downstreams {
+		if d == nil {
+			return fmt.Errorf("empty or null downstream in topology route %q", r.Path)
+		}
+	}
+	return nil
+}
+
+// Downstream is a service called by a topology route.
+type Downstream struct {
+	URL     string         `yaml:"url"`
+	Timeout model.Duration `yaml:"timeout,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (d *Downstream) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*d = DefaultDownstream
+	type plain Downstream
+	if err := unmarshal((*plain)(d)); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return fmt.Errorf("invalid downstream URL %q: %w", d.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("downstream URL %q must use the http or https scheme", d.URL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("downstream URL %q has no host", d.URL)
+	}
+	if d.Timeout <= 0 {
+		return fmt.Errorf("timeout of downstream %q must be positive, got %s", d.URL, d.Timeout)
+	}
+	return nil
+}
+
+// TracingConfig configures the export of the spans recorded by the HTTP
+// server and the downstream calls.
+type TracingConfig struct {
+	ClientType         TracingClientType           `yaml:"client_type,omitempty"`
+	Endpoint           string                      `yaml:"endpoint,omitempty"`
+	File               string                      `yaml:"file,omitempty"`
+	SamplingFraction   float64                     `yaml:"sampling_fraction,omitempty"`
+	Insecure           bool                        `yaml:"insecure,omitempty"`
+	TLSConfig          commoncfg.TLSConfig         `yaml:"tls_config,omitempty"`
+	Headers            map[string]commoncfg.Secret `yaml:"headers,omitempty"`
+	Compression        string                      `yaml:"compression,omitempty"`
+	Timeout            model.Duration              `yaml:"timeout,omitempty"`
+	ResourceAttributes map[string]string           `yaml:"resource_attributes,omitempty"`
+}
+
+// Enabled returns whether spans are exported at all. The OTLP clients need an
+// endpoint to be enabled.
+func (t TracingConfig) Enabled() bool {
+	switch t.ClientType {
+	case TracingClientStdout, TracingClientFile:
+		return true
+	default:
+		return t.Endpoint != ""
+	}
+}
+
+// SetDirectory joins any relative file paths with dir.
+func (t *TracingConfig) SetDirectory(dir string) {
+	t.File = commoncfg.JoinDir(dir, t.File)
+	t.TLSConfig.SetDirectory(dir)
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (t *TracingConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*t = DefaultTracingConfig
+	type plain TracingConfig
+	if err := unmarshal((*plain)(t)); err != nil {
+		return err
+	}
+
+	switch t.ClientType {
+	case TracingClientGRPC, TracingClientHTTP, TracingClientStdout:
+	case TracingClientFile:
+		if t.File == "" {
+			return errors.New("tracing file must be set with the file client type")
+		}
+	default:
+		return fmt.Errorf("unknown tracing client type %q", t.ClientType)
+	}
+
+	if t.SamplingFraction < 0 || t.SamplingFraction > 1 {
+		return fmt.Errorf("tracing sampling fraction must be between 0 and 1, got %v", t.SamplingFraction)
+	}
+
+	switch t.Compression {
+	case "", TracingCompressionGzip:
+	default:
+		return fmt.Errorf("invalid tracing compression type %q", t.Compression)
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/promslog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load("")
+	require.NoError(t, err)
+	require.Equal(t, DefaultConfig.AccessLog, cfg.AccessLog)
+	require.Equal(t, DefaultConfig.Tracing, cfg.Tracing)
+	require.Equal(t, DefaultConfig.LoadShedding, cfg.LoadShedding)
+
+	cfg, err = Load(`
+topology:
+  routes:
+  - path: /a
+    downstreams:
+    - url: http://b
+rate_limits:
+  global:
+    rate: 1.5
+`)
+	require.NoError(t, err)
+	route := cfg.Topology.Route("/a")
+	require.NotNil(t, route)
+	require.Equal(t, CallModeSerial, route.Mode)
+	require.Equal(t, model.Duration(10*time.Second), route.Timeout)
+	require.Equal(t, model.Duration(5*time.Second), route.Downstreams[0].Timeout)
+	require.Equal(t, 2, cfg.RateLimits.Global.Burst)
+}
+
+func TestLoadErrors(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config string
+	}{
+		{
+			name:   "unknown access log format",
+			config: "access_log: {format: xml}",
+		},
+		{
+			name:   "duplicate topology route",
+			config: "topology: {routes: [{path: /a}, {path: /a}]}",
+		},
+		{
+			name:   "relative topology route",
+			config: "topology: {routes: [{path: a}]}",
+		},
+		{
+			name:   "downstream without scheme",
+			config: "topology: {routes: [{path: /a, downstreams: [{url: b}]}]}",
+		},
+		{
+			name:   "zero topology route timeout",
+			config: "topology: {routes: [{path: /a, timeout: 0s}]}",
+		},
+		{
+			name:   "negative topology route timeout",
+			config: "topology: {routes: [{path: /a, timeout: -1s}]}",
+		},
+		{
+			name:   "zero downstream timeout",
+			config: "topology: {routes: [{path: /a, downstreams: [{url: http://b, timeout: 0s}]}]}",
+		},
+		{
+			name:   "tracing file without path",
+			config: "tracing: {client_type: file}",
+		},
+		{
+			name:   "invalid trusted proxy",
+			config: "trusted_proxies: [10.0.0.0/33]",
+		},
+		{
+			name:   "reserved slots without matcher",
+			config: "connections: {reserved: {slots: 1}}",
+		},
+		{
+			name:   "non positive rate",
+			config: "rate_limits: {global: {rate: 0}}",
+		},
+		{
+			name:   "duplicate route timeout",
+			config: "request_timeouts: {routes: [{handler: /a, timeout: 1s}, {handler: /a, timeout: 2s}]}",
+		},
+		{
+			name:   "load shedding limits",
+			config: "load_shedding: {enabled: true, min_limit: 10, max_limit: 5}",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Load(tc.config)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(filename, []byte("tracing: {client_type: file, file: spans.json, tls_config: {ca_file: ca.pem}}"), 0o644))
+
+	cfg, err := LoadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "spans.json"), cfg.Tracing.File)
+	require.Equal(t, filepath.Join(dir, "ca.pem"), cfg.Tracing.TLSConfig.CAFile)
+
+	absolute := filepath.Join(t.TempDir(), "spans.json")
+	require.NoError(t, os.WriteFile(filename, []byte("tracing: {client_type: file, file: "+absolute+"}"), 0o644))
+	cfg, err = LoadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, absolute, cfg.Tracing.File)
+
+	_, err = LoadFile(filepath.Join(dir, "missing.yaml"))
+	require.Error(t, err)
+}
+
+func TestTracingHeadersHidden(t *testing.T) {
+	cfg, err := Load(`
+tracing:
+  endpoint: localhost:4317
+  headers:
+    Authorization: Bearer token
+`)
+	require.NoError(t, err)
+	require.Equal(t, "Bearer token", string(cfg.Tracing.Headers["Authorization"]))
+	require.NotContains(t, cfg.String(), "Bearer token")
+	require.Contains(t, cfg.String(), "Authorization: <secret>")
+}
+
+func TestCoordinatorReplace(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "demoapp.yml")
+	require.NoError(t, os.WriteFile(file, []byte("date_format: old\n"), 0o600))
+
+	c := NewCoordinator(file, prometheus.NewRegistry(), promslog.NewNopLogger())
+	var applied []string
+	var failApply bool
+	c.Subscribe(func(cfg *Config) error {
+		if failApply {
+			return errors.New("apply failed")
+		}
+		applied = append(applied, cfg.DateFormat)
+		return nil
+	})
+	require.NoError(t, c.Reload())
+
+	// Invalid content is rejected before the file is written.
+	err := c.Replace([]byte("date_format: [\n"))
+	require.ErrorIs(t, err, ErrInvalidConfig)
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, "date_format: old\n", string(content))
+
+	// The previous file is restored if the configuration can't be applied.
+	failApply = true
+	err = c.Replace([]byte("date_format: failed\n"))
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrInvalidConfig)
+	content, err = os.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, "date_format: old\n", string(content))
+
+	failApply = false
+	require.NoError(t, c.Replace([]byte("date_format: new\n")))
+	content, err = os.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, "date_format: new\n", string(content))
+	require.Equal(t, []string{"old", "new"}, applied)
+
+	fi, err := os.Stat(file)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+}
@@ -16,7 +16,11 @@ package config
 import (
 	"crypto/md5"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"log/slog"
+	"os"
+	"path/filepath"
 	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -109,6 +113,72 @@ func (c *Coordinator) Reload() error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	return c.reload()
+}
+
+// ErrInvalidConfig is wrapped by the errors of Replace when the content isn't
+// a valid configuration.
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// Replace writes content to the configuration file and reloads it. The
+// previous file is restored if the new configuration can't be applied.
+func (c *Coordinator) Replace(content []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, err := Load(string(content)); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	previous, err := os.ReadFile(c.configFilePath)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(c.configFilePath, content); err != nil {
+		return err
+	}
+
+	c.logger.Info("Configuration file replaced", "file", c.configFilePath)
+	if err := c.reload(); err != nil {
+		if rerr := writeFile(c.configFilePath, previous); rerr != nil {
+			c.logger.Error("Restoring the previous configuration file failed", "file", c.configFilePath, "err", rerr)
+			return err
+		}
+		c.logger.Warn("Restored the previous configuration file", "file", c.configFilePath)
+		if rerr := c.reload(); rerr != nil {
+			c.logger.Error("Reloading the previous configuration file failed", "file", c.configFilePath, "err", rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// writeFile replaces the file atomically, keeping its permissions.
+func writeFile(filename string, content []byte) error {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+func (c *Coordinator) reload() error {
 	c.logger.Info(
 		"Loading configuration file",
 		"file", c.configFilePath,
@@ -0,0 +1,194 @@
+// Package l4echo provides raw TCP and UDP echo servers which are useful for
+// testing layer 4 load balancers and services.
+package l4echo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mwitkow/go-conntrack"
+
+	"github.com/ilolicon/demoapp/util/netconnlimit"
+)
+
+const (
+	// maxDatagramSize is the largest UDP payload which can be received.
+	maxDatagramSize = 64 << 10
+	// maxReplySize is the largest UDP payload which can be sent over IPv4,
+	// replies are truncated to it.
+	maxReplySize = 65535 - 8 - 20
+)
+
+// Banner returns the line prepended to every echoed payload. It identifies
+// the instance in the same way as the root HTTP endpoint.
+func Banner(appName, versionInfo string) []byte {
+	hostname, _ := os.Hostname()
+	return []byte(fmt.Sprintf("%s | %s | %s\n", appName, hostname, versionInfo))
+}
+
+// LimitListener wraps the TCP listener of the echo server. Connections are
+// limited by the given shared semaphore and tracked with conntrack.
+func LimitListener(listener net.Listener, sem *netconnlimit.Semaphore) net.Listener {
+	listener = netconnlimit.SharedLimitListener(listener, sem)
+
+	// Monitor incoming connections with conntrack.
+	return conntrack.NewListener(listener,
+		conntrack.TrackWithName("tcp_echo"),
+		conntrack.TrackWithTracing())
+}
+
+// TCPServer echoes everything it reads on a connection back to the client
+// after sending the banner.
+type TCPServer struct {
+	logger      *slog.Logger
+	listener    net.Listener
+	banner      []byte
+	idleTimeout time.Duration
+}
+
+// NewTCPServer returns a new TCPServer serving on the given listener. A zero
+// idleTimeout keeps idle connections open forever.
+func NewTCPServer(logger *slog.Logger, listener net.Listener, banner []byte, idleTimeout time.Duration) *TCPServer {
+	return &TCPServer{
+		logger:      logger,
+		listener:    listener,
+		banner:      banner,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// Run accepts connections until the context is canceled. Open connections are
+// closed before it returns.
+func (s *TCPServer) Run(ctx context.Context) error {
+	s.logger.Info("Listening on", "address", s.listener.Addr().String())
+
+	var (
+		wg    sync.WaitGroup
+		mtx   sync.Mutex
+		conns = map[net.Conn]struct{}{}
+	)
+	go func() {
+		<-ctx.Done()
+		s.listener.Close()
+		mtx.Lock()
+		for c := range conns {
+			c.Close()
+		}
+		mtx.Unlock()
+	}()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			wg.Wait()
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		// The connections are closed under the mutex once the context is
+		// canceled, a connection accepted meanwhile is closed right away.
+		mtx.Lock()
+		if ctx.Err() != nil {
+			mtx.Unlock()
+			conn.Close()
+			continue
+		}
+		conns[conn] = struct{}{}
+		mtx.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serve(conn)
+			mtx.Lock()
+			delete(conns, conn)
+			mtx.Unlock()
+		}()
+	}
+}
+
+func (s *TCPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	if _, err := conn.Write(s.banner); err != nil {
+		s.logger.Debug("Error writing banner", "client", conn.RemoteAddr(), "err", err)
+		return
+	}
+
+	buf := make([]byte, 32<<10)
+	for {
+		if s.idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		}
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				s.logger.Debug("Error echoing payload", "client", conn.RemoteAddr(), "err", werr)
+				return
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logger.Debug("Error reading payload", "client", conn.RemoteAddr(), "err", err)
+			}
+			return
+		}
+	}
+}
+
+// UDPServer answers every datagram with the banner followed by the payload,
+// truncated to the maximum size of a datagram.
+type UDPServer struct {
+	logger *slog.Logger
+	conn   net.PacketConn
+	banner []byte
+}
+
+// NewUDPServer returns a new UDPServer serving on the given packet connection.
+func NewUDPServer(logger *slog.Logger, conn net.PacketConn, banner []byte) *UDPServer {
+	return &UDPServer{
+		logger: logger,
+		conn:   conn,
+		banner: banner,
+	}
+}
+
+// Run serves datagrams until the context is canceled.
+func (s *UDPServer) Run(ctx context.Context) error {
+	s.logger.Info("Listening on", "address", s.conn.LocalAddr().String())
+
+	go func() {
+		<-ctx.Done()
+		s.conn.Close()
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		resp := make([]byte, 0, len(s.banner)+n)
+		resp = append(resp, s.banner...)
+		resp = append(resp, buf[:n]...)
+		if len(resp) > maxReplySize {
+			resp = resp[:maxReplySize]
+		}
+		if _, err := s.conn.WriteTo(resp, addr); err != nil {
+			s.logger.Debug("Error echoing datagram", "client", addr, "err", err)
+		}
+	}
+}
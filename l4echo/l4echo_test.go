@@ -0,0 +1,80 @@
+package l4echo
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := NewTCPServer(promslog.NewNopLogger(), listener, []byte("banner\n"), 0)
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(ctx)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "banner\n", line)
+
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err = r.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", line)
+
+	// Without idle timeout, the open connection is closed on shutdown.
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't stop with an open connection")
+	}
+	_, err = r.ReadString('\n')
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestUDPServer(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := NewUDPServer(promslog.NewNopLogger(), conn, []byte("banner\n"))
+	go srv.Run(ctx)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, maxDatagramSize)
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	n, err := client.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "banner\nhello", string(buf[:n]))
+
+	// The banner doesn't push the largest payload over the datagram size.
+	_, err = client.Write(make([]byte, maxReplySize))
+	require.NoError(t, err)
+	n, err = client.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, maxReplySize, n)
+}
@@ -0,0 +1,94 @@
+package chilog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/require"
+)
+
+func serve(l *Logger, status int, r *http.Request) {
+	h := middleware.RequestLogger(l)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte("hello"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestCombinedFormat(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, FormatCombined, nil)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/echo?a=b", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.SetBasicAuth("alice", "secret")
+	r.Header.Set("Referer", "http://example.com/")
+	r.Header.Set("User-Agent", "test")
+	serve(l, http.StatusCreated, r)
+
+	require.Regexp(t,
+		regexp.MustCompile(`^192\.0\.2\.1 - alice \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /echo\?a=b HTTP/1\.1" 201 5 "http://example\.com/" "test"\n$`),
+		buf.String())
+
+	// The resolved client address takes precedence over the peer address.
+	buf.Reset()
+	l.ClientIP = func(*http.Request) string { return "198.51.100.1" }
+	serve(l, http.StatusOK, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.True(t, strings.HasPrefix(buf.String(), "198.51.100.1 - - ["), buf.String())
+	require.Contains(t, buf.String(), `"GET / HTTP/1.1" 200 5 "-" "-"`)
+}
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, FormatJSON, nil)
+	require.NoError(t, err)
+	l.ClientIP = func(*http.Request) string { return "198.51.100.1" }
+
+	r := httptest.NewRequest(http.MethodPost, "/echo", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	middleware.RequestID(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		serve(l, http.StatusNotFound, r)
+	})).ServeHTTP(httptest.NewRecorder(), r)
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "request complete", entry["msg"])
+	require.NotEmpty(t, entry["req_id"])
+	require.Equal(t, "POST", entry["http_method"])
+	require.Equal(t, "192.0.2.1:1234", entry["remote_addr"])
+	require.Equal(t, "198.51.100.1", entry["client_ip"])
+	require.Equal(t, "http://example.com/echo", entry["uri"])
+	require.Equal(t, float64(http.StatusNotFound), entry["resp_status"])
+	require.Equal(t, float64(5), entry["resp_bytes_length"])
+}
+
+func TestSuccessSampling(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, FormatCombined, nil)
+	require.NoError(t, err)
+	l.SuccessSampling = 3
+
+	for i := 0; i < 6; i++ {
+		serve(l, http.StatusOK, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	require.Equal(t, 2, strings.Count(buf.String(), "\n"))
+
+	// Errors are always logged.
+	buf.Reset()
+	for i := 0; i < 3; i++ {
+		serve(l, http.StatusInternalServerError, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	require.Equal(t, 3, strings.Count(buf.String(), "\n"))
+}
+
+func TestUnknownFormat(t *testing.T) {
+	_, err := New(&bytes.Buffer{}, "xml", nil)
+	require.Error(t, err)
+}
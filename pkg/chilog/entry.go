@@ -1,8 +1,11 @@
 package chilog
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"time"
 
@@ -13,10 +16,27 @@ var _ middleware.LogEntry = (*LogEntry)(nil)
 
 type LogEntry struct {
 	Logger *slog.Logger // field logger interface, created by RequestLogger
+
+	ctx      context.Context
+	sample   func(status int) bool
+	combined *combinedEntry
 }
 
 func (l *LogEntry) Write(status, bytes int, header http.Header, elapsed time.Duration, extra interface{}) {
-	l.Logger.Info("request complete",
+	if status == 0 {
+		// Nothing was written, net/http answers with 200.
+		status = http.StatusOK
+	}
+	if l.sample != nil && !l.sample(status) {
+		return
+	}
+
+	if l.combined != nil {
+		l.combined.write(status, bytes)
+		return
+	}
+
+	l.Logger.InfoContext(l.ctx, "request complete",
 		"resp_status", status,
 		"resp_bytes_length", bytes,
 		"resp_elapsed_ms", float64(elapsed.Nanoseconds())/1000000.0,
@@ -24,8 +44,57 @@ func (l *LogEntry) Write(status, bytes int, header http.Header, elapsed time.Dur
 }
 
 func (l *LogEntry) Panic(rec interface{}, stack []byte) {
-	l.Logger.Error("panic recovered",
+	if l.Logger == nil {
+		return
+	}
+	l.Logger.ErrorContext(l.ctx, "panic recovered",
 		"stack", string(stack),
 		"panic", fmt.Sprintf("%+v", rec),
 	)
 }
+
+// combinedEntry holds the request fields of an entry in the Apache combined
+// log format.
+type combinedEntry struct {
+	out        io.Writer
+	remoteAddr string
+	clientIP   string
+	user       string
+	start      time.Time
+	request    string
+	referer    string
+	userAgent  string
+}
+
+func (c *combinedEntry) write(status, bytes int) {
+	host := c.clientIP
+	if host == "" {
+		var err error
+		if host, _, err = net.SplitHostPort(c.remoteAddr); err != nil {
+			host = c.remoteAddr
+		}
+	}
+
+	size := "-"
+	if bytes > 0 {
+		size = fmt.Sprint(bytes)
+	}
+
+	fmt.Fprintf(c.out, "%s - %s [%s] %q %d %s %q %q\n",
+		orDash(host),
+		orDash(c.user),
+		c.start.Format("02/Jan/2006:15:04:05 -0700"),
+		c.request,
+		status,
+		size,
+		orDash(c.referer),
+		orDash(c.userAgent),
+	)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
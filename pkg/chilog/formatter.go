@@ -2,18 +2,104 @@ package chilog
 
 import (
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-chi/chi/v5/middleware"
 )
 
+// Format is the output format of the access log.
+type Format string
+
+const (
+	FormatJSON     Format = "json"
+	FormatLogfmt   Format = "logfmt"
+	FormatCombined Format = "combined"
+)
+
+// Formats lists the supported access log formats.
+var Formats = []Format{FormatJSON, FormatLogfmt, FormatCombined}
+
+var _ middleware.LogFormatter = (*Logger)(nil)
+
 type Logger struct {
-	Logger *slog.Logger
+	Logger *slog.Logger // used for the json and logfmt formats
+
+	Format Format
+	Out    io.Writer // used for the combined format
+
+	// SuccessSampling writes only 1 in N entries of requests answered with
+	// a status code below 400. 0 and 1 write all entries.
+	SuccessSampling uint64
+
+	// ClientIP returns the address of the client which sent the request,
+	// the peer address is logged if it is nil or returns an empty string.
+	ClientIP func(r *http.Request) string
+
+	successes atomic.Uint64
+}
+
+// sample returns whether the entry of a request with the given status code
+// must be written.
+func (l *Logger) sample(status int) bool {
+	if status >= http.StatusBadRequest || l.SuccessSampling <= 1 {
+		return true
+	}
+	return l.successes.Add(1)%l.SuccessSampling == 1
+}
+
+func (l *Logger) clientIP(r *http.Request) string {
+	if l.ClientIP == nil {
+		return ""
+	}
+	return l.ClientIP(r)
+}
+
+// New returns a Logger writing entries in the given format to w.
+func New(w io.Writer, format Format, wrap func(slog.Handler) slog.Handler) (*Logger, error) {
+	var h slog.Handler
+	switch format {
+	case FormatJSON:
+		h = slog.NewJSONHandler(w, nil)
+	case FormatLogfmt:
+		h = slog.NewTextHandler(w, nil)
+	case FormatCombined:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+
+	l := &Logger{Format: format, Out: w}
+	if h != nil {
+		if wrap != nil {
+			h = wrap(h)
+		}
+		l.Logger = slog.New(h)
+	}
+	return l, nil
 }
 
 func (l *Logger) NewLogEntry(r *http.Request) middleware.LogEntry {
-	entry := &LogEntry{Logger: l.Logger}
+	entry := &LogEntry{Logger: l.Logger, ctx: r.Context(), sample: l.sample}
+	if l.Format == FormatCombined {
+		entry.combined = &combinedEntry{
+			out:        l.Out,
+			remoteAddr: r.RemoteAddr,
+			clientIP:   l.clientIP(r),
+			start:      time.Now(),
+			request:    fmt.Sprintf("%s %s %s", r.Method, r.RequestURI, r.Proto),
+			referer:    r.Referer(),
+			userAgent:  r.UserAgent(),
+		}
+		if r.URL.User != nil {
+			entry.combined.user = r.URL.User.Username()
+		} else if u, _, ok := r.BasicAuth(); ok {
+			entry.combined.user = u
+		}
+		return entry
+	}
 
 	fields := make([]interface{}, 0, 16)
 	if reqID := middleware.GetReqID(r.Context()); reqID != "" {
@@ -28,6 +114,9 @@ func (l *Logger) NewLogEntry(r *http.Request) middleware.LogEntry {
 	fields = append(fields, "http_proto", r.Proto)
 	fields = append(fields, "http_method", r.Method)
 	fields = append(fields, "remote_addr", r.RemoteAddr)
+	if clientIP := l.clientIP(r); clientIP != "" {
+		fields = append(fields, "client_ip", clientIP)
+	}
 	fields = append(fields, "user_agent", r.UserAgent())
 	fields = append(fields, "uri", fmt.Sprintf("%s://%s%s", scheme, r.Host, r.RequestURI))
 
@@ -0,0 +1,380 @@
+// Package client is a Go client for the HTTP API of demoapp.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	config_util "github.com/prometheus/common/config"
+
+	api_v1 "github.com/ilolicon/demoapp/web/api/v1"
+)
+
+// maxErrorBodySize limits how much of a response body is read into an error.
+const maxErrorBodySize = 1 << 16
+
+// DefaultConfig is the default client configuration.
+var DefaultConfig = Config{
+	HTTPClientConfig: config_util.DefaultHTTPClientConfig,
+	Retries:          2,
+	RetryBackoff:     100 * time.Millisecond,
+}
+
+// Config configures a Client.
+type Config struct {
+	// Address is the base URL of the server, e.g. http://localhost:8080.
+	Address string
+	// HTTPClientConfig configures TLS, basic authentication and the other
+	// HTTP client settings, matching the TLS and basic auth settings of the
+	// web configuration file of the server.
+	HTTPClientConfig config_util.HTTPClientConfig
+	// Retries is the number of times a GET request is retried after a
+	// connection error, or a 429 or 503 response. The other requests change
+	// the state of the server and are never retried, since they may have
+	// been processed.
+	Retries int
+	// RetryBackoff is the wait before the first retry, doubled on every
+	// retry. The Retry-After header of the response takes precedence.
+	RetryBackoff time.Duration
+}
+
+// Client calls the HTTP API of a demoapp server.
+type Client struct {
+	endpoint *url.URL
+	client   *http.Client
+
+	retries      int
+	retryBackoff time.Duration
+}
+
+// New returns a client of the server at cfg.Address.
+func New(cfg Config) (*Client, error) {
+	u, err := url.Parse(cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", cfg.Address, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid address %q: scheme must be http or https", cfg.Address)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+
+	if err := cfg.HTTPClientConfig.Validate(); err != nil {
+		return nil, err
+	}
+	c, err := config_util.NewClientFromConfig(cfg.HTTPClientConfig, "demoapp")
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		endpoint:     u,
+		client:       c,
+		retries:      cfg.Retries,
+		retryBackoff: cfg.RetryBackoff,
+	}, nil
+}
+
+// Address returns the base URL of the server.
+func (c *Client) Address() string {
+	return c.endpoint.String()
+}
+
+// BuildInfo returns the build information of the server.
+func (c *Client) BuildInfo(ctx context.Context) (*api_v1.DemoappVersion, error) {
+	var v api_v1.DemoappVersion
+	if err := c.api(ctx, request{method: http.MethodGet, path: "/status/buildinfo"}, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// RuntimeInfo returns the runtime information of the server.
+func (c *Client) RuntimeInfo(ctx context.Context) (*api_v1.RuntimeInfo, error) {
+	var v api_v1.RuntimeInfo
+	if err := c.api(ctx, request{method: http.MethodGet, path: "/status/runtimeinfo"}, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Config returns the configuration file loaded by the server.
+func (c *Client) Config(ctx context.Context) (string, error) {
+	var v struct {
+		YAML string `json:"yaml"`
+	}
+	if err := c.api(ctx, request{method: http.MethodGet, path: "/status/config"}, &v); err != nil {
+		return "", err
+	}
+	return v.YAML, nil
+}
+
+// PutConfig replaces the configuration file of the server and reloads it. It
+// returns the configuration loaded by the server. The previous file is kept
+// if the configuration can't be applied. It requires the configuration API,
+// enabled with --web.enable-config-api.
+func (c *Client) PutConfig(ctx context.Context, content []byte) (string, error) {
+	var v struct {
+		YAML string `json:"yaml"`
+	}
+	req := request{method: http.MethodPut, path: "/status/config", body: content, contentType: "application/yaml"}
+	if err := c.api(ctx, req, &v); err != nil {
+		return "", err
+	}
+	return v.YAML, nil
+}
+
+// Flags returns the command line flag values of the server.
+func (c *Client) Flags(ctx context.Context) (map[string]string, error) {
+	var v map[string]string
+	if err := c.api(ctx, request{method: http.MethodGet, path: "/status/flags"}, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Date returns the current date of the server, in its configured format.
+func (c *Client) Date(ctx context.Context) (string, error) {
+	var v string
+	if err := c.api(ctx, request{method: http.MethodGet, path: "/status/date"}, &v); err != nil {
+		return "", err
+	}
+	return v, nil
+}
+
+// Metrics returns the metric families whose names match any of the regular
+// expressions, or all of them without matchers.
+func (c *Client) Metrics(ctx context.Context, match ...string) ([]api_v1.MetricFamily, error) {
+	var v []api_v1.MetricFamily
+	if err := c.api(ctx, request{method: http.MethodGet, path: "/status/metrics", args: url.Values{"match": match}}, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// LogLevel returns the logging levels of the server.
+func (c *Client) LogLevel(ctx context.Context) (*api_v1.LogLevelStatus, error) {
+	var v api_v1.LogLevelStatus
+	if err := c.api(ctx, request{method: http.MethodGet, path: "/status/loglevel"}, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// SetLogLevel sets the root logging level, or the level of component if it
+// isn't empty. It requires the lifecycle API.
+func (c *Client) SetLogLevel(ctx context.Context, level, component string) (*api_v1.LogLevelStatus, error) {
+	args := url.Values{"level": {level}}
+	if component != "" {
+		args.Set("component", component)
+	}
+	var v api_v1.LogLevelStatus
+	if err := c.api(ctx, request{method: http.MethodPut, path: "/status/loglevel", args: args}, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Version returns the build information served by the version endpoint.
+func (c *Client) Version(ctx context.Context) (*api_v1.DemoappVersion, error) {
+	body, err := c.do(ctx, request{method: http.MethodGet, path: "/version"})
+	if err != nil {
+		return nil, err
+	}
+	var v api_v1.DemoappVersion
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+	return &v, nil
+}
+
+// Reload makes the server reload its configuration file. The error returned
+// by the server is reported if the configuration couldn't be loaded. It
+// requires the lifecycle API.
+func (c *Client) Reload(ctx context.Context) error {
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/-/reload"})
+	return err
+}
+
+// Quit shuts the server down. It requires the lifecycle API.
+func (c *Client) Quit(ctx context.Context) error {
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/-/quit"})
+	return err
+}
+
+// Ready returns whether the readiness probe of the server succeeds.
+func (c *Client) Ready(ctx context.Context) (bool, error) {
+	// Not ready is an answer, it isn't retried.
+	_, _, err := c.doOnce(ctx, request{method: http.MethodGet, path: "/-/ready"})
+	if errors.Is(err, ErrUnavailable) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// FailReady makes the readiness probe of the server fail, e.g. to drain it,
+// while the other endpoints keep serving. It requires the lifecycle API.
+func (c *Client) FailReady(ctx context.Context) error {
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/-/ready/fail"})
+	return err
+}
+
+// RestoreReady restores the readiness probe failed by FailReady. It requires
+// the lifecycle API.
+func (c *Client) RestoreReady(ctx context.Context) error {
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/-/ready/restore"})
+	return err
+}
+
+// apiResponse is the envelope of the v1 API responses.
+type apiResponse struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data"`
+	ErrorType ErrorType       `json:"errorType"`
+	Error     string          `json:"error"`
+}
+
+// request is a request to the server. The arguments are sent in the query
+// string of GET requests and as a form otherwise, unless body is set.
+type request struct {
+	method      string
+	path        string
+	args        url.Values
+	body        []byte
+	contentType string
+}
+
+// api calls an endpoint of the v1 API and decodes the data of the response
+// into v.
+func (c *Client) api(ctx context.Context, req request, v interface{}) error {
+	req.path = "/api/v1" + req.path
+	body, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	var resp apiResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("error decoding response: %w", err)
+	}
+	if resp.Status != "success" {
+		return &Error{Type: resp.ErrorType, Message: resp.Error}
+	}
+	if err := json.Unmarshal(resp.Data, v); err != nil {
+		return fmt.Errorf("error decoding response data: %w", err)
+	}
+	return nil
+}
+
+// do sends a request and returns the body of a successful response. GET
+// requests are sent with the retries of the client.
+func (c *Client) do(ctx context.Context, req request) ([]byte, error) {
+	retries := c.retries
+	if req.method != http.MethodGet {
+		retries = 0
+	}
+	backoff := c.retryBackoff
+	for attempt := 0; ; attempt++ {
+		body, wait, err := c.doOnce(ctx, req)
+		if err == nil || wait < 0 || attempt >= retries {
+			return body, err
+		}
+		if wait == 0 {
+			wait = backoff
+			backoff *= 2
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// doOnce sends a single request. The returned duration is the delay before
+// the request can be retried, 0 if unknown, or negative if the error is not
+// worth a retry.
+func (c *Client) doOnce(ctx context.Context, r request) ([]byte, time.Duration, error) {
+	u := *c.endpoint
+	u.Path += r.path
+
+	var (
+		reqBody     io.Reader
+		contentType = r.contentType
+	)
+	switch {
+	case r.body != nil:
+		reqBody = bytes.NewReader(r.body)
+	case r.method == http.MethodGet:
+		u.RawQuery = r.args.Encode()
+	default:
+		reqBody = strings.NewReader(r.args.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	}
+	req, err := http.NewRequestWithContext(ctx, r.method, u.String(), reqBody)
+	if err != nil {
+		return nil, -1, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, -1, err
+		}
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading response: %w", err)
+	}
+	if resp.StatusCode/100 == 2 {
+		return body, 0, nil
+	}
+
+	err = responseError(resp, body)
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return nil, retryAfter(resp.Header.Get("Retry-After")), err
+	}
+	return nil, -1, err
+}
+
+// responseError returns the error of a failed response, decoded from the API
+// envelope if the response has one.
+func responseError(resp *http.Response, body []byte) error {
+	var env apiResponse
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") &&
+		json.Unmarshal(body, &env) == nil && env.Status == "error" {
+		return &Error{Type: env.ErrorType, Message: env.Error, StatusCode: resp.StatusCode}
+	}
+	if len(body) > maxErrorBodySize {
+		body = body[:maxErrorBodySize]
+	}
+	return &Error{
+		Type:       errorTypeOf(resp.StatusCode),
+		Message:    string(bytes.TrimSpace(body)),
+		StatusCode: resp.StatusCode,
+	}
+}
+
+// retryAfter parses the delay in seconds of a Retry-After header, 0 if it is
+// missing or invalid.
+func retryAfter(h string) time.Duration {
+	s, err := strconv.Atoi(h)
+	if err != nil || s < 0 {
+		return 0
+	}
+	return time.Duration(s) * time.Second
+}
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(t *testing.T, h http.HandlerFunc) *Client {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	cfg := DefaultConfig
+	cfg.Address = srv.URL
+	cfg.RetryBackoff = time.Millisecond
+	c, err := New(cfg)
+	require.NoError(t, err)
+	return c
+}
+
+func TestClientDecodesResponse(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v1/status/buildinfo", r.URL.Path)
+		require.Equal(t, "application/json", r.Header.Get("Accept"))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":"success","data":{"version":"1.2.3","goVersion":"go1.23"}}`)
+	})
+
+	v, err := c.BuildInfo(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "1.2.3", v.Version)
+	require.Equal(t, "go1.23", v.GoVersion)
+}
+
+func TestClientErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		code        int
+		contentType string
+		body        string
+		expected    error
+	}{
+		{
+			name:        "api error",
+			code:        http.StatusBadRequest,
+			contentType: "application/json",
+			body:        `{"status":"error","errorType":"bad_data","error":"invalid level"}`,
+			expected:    ErrBadData,
+		},
+		{
+			name:        "lifecycle disabled",
+			code:        http.StatusForbidden,
+			contentType: "text/plain",
+			body:        "Lifecycle API is not enabled.",
+			expected:    ErrForbidden,
+		},
+		{
+			name:        "reload failed",
+			code:        http.StatusInternalServerError,
+			contentType: "text/plain",
+			body:        "failed to reload config: bad file",
+			expected:    ErrInternal,
+		},
+		{
+			name:        "rate limited",
+			code:        http.StatusTooManyRequests,
+			contentType: "text/plain",
+			body:        "rate limit exceeded (global)",
+			expected:    ErrRateLimited,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", tc.contentType)
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(tc.code)
+				fmt.Fprint(w, tc.body)
+			})
+
+			err := c.Reload(context.Background())
+			require.ErrorIs(t, err, tc.expected)
+			var apiErr *Error
+			require.True(t, errors.As(err, &apiErr))
+			require.Equal(t, tc.code, apiErr.StatusCode)
+		})
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var requests atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		if requests.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":"success","data":"2025-01-01"}`)
+	})
+
+	date, err := c.Date(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "2025-01-01", date)
+	require.Equal(t, int32(3), requests.Load())
+
+	// Errors other than 429 and 503 are not retried.
+	requests.Store(0)
+	c = newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusForbidden)
+	})
+	_, err = c.Flags(context.Background())
+	require.ErrorIs(t, err, ErrForbidden)
+	require.Equal(t, int32(1), requests.Load())
+}
+
+func TestClientNoRetries(t *testing.T) {
+	var requests atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	// Requests changing the state of the server are not retried.
+	for name, call := range map[string]func(context.Context) error{
+		"quit":          c.Quit,
+		"reload":        c.Reload,
+		"fail ready":    c.FailReady,
+		"restore ready": c.RestoreReady,
+		"put config": func(ctx context.Context) error {
+			_, err := c.PutConfig(ctx, []byte("{}"))
+			return err
+		},
+	} {
+		requests.Store(0)
+		require.ErrorIs(t, call(context.Background()), ErrUnavailable, name)
+		require.Equal(t, int32(1), requests.Load(), name)
+	}
+
+	// Nor after connection errors.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		panic(http.ErrAbortHandler)
+	}))
+	defer srv.Close()
+	cfg := DefaultConfig
+	cfg.Address = srv.URL
+	cfg.RetryBackoff = time.Millisecond
+	c, err := New(cfg)
+	require.NoError(t, err)
+
+	requests.Store(0)
+	require.Error(t, c.Reload(context.Background()))
+	require.Equal(t, int32(1), requests.Load())
+	requests.Store(0)
+	_, err = c.Date(context.Background())
+	require.Error(t, err)
+	require.Equal(t, int32(3), requests.Load())
+}
+
+func TestClientReady(t *testing.T) {
+	var requests atomic.Int32
+	ready := true
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		require.Equal(t, "/-/ready", r.URL.Path)
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	ok, err := c.Ready(context.Background())
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Not ready is not retried.
+	ready = false
+	requests.Store(0)
+	ok, err = c.Ready(context.Background())
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, int32(1), requests.Load())
+}
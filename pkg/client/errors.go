@@ -0,0 +1,88 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ErrorType is the errorType of the API responses.
+type ErrorType string
+
+const (
+	ErrorTypeTimeout       ErrorType = "timeout"
+	ErrorTypeCanceled      ErrorType = "canceled"
+	ErrorTypeExecution     ErrorType = "execution"
+	ErrorTypeBadData       ErrorType = "bad_data"
+	ErrorTypeInternal      ErrorType = "internal"
+	ErrorTypeUnavailable   ErrorType = "unavailable"
+	ErrorTypeNotFound      ErrorType = "not_found"
+	ErrorTypeNotAcceptable ErrorType = "not_acceptable"
+	ErrorTypeForbidden     ErrorType = "forbidden"
+)
+
+// Errors matching the error types with errors.Is.
+var (
+	ErrTimeout       = &Error{Type: ErrorTypeTimeout}
+	ErrCanceled      = &Error{Type: ErrorTypeCanceled}
+	ErrExecution     = &Error{Type: ErrorTypeExecution}
+	ErrBadData       = &Error{Type: ErrorTypeBadData}
+	ErrInternal      = &Error{Type: ErrorTypeInternal}
+	ErrUnavailable   = &Error{Type: ErrorTypeUnavailable}
+	ErrNotFound      = &Error{Type: ErrorTypeNotFound}
+	ErrNotAcceptable = &Error{Type: ErrorTypeNotAcceptable}
+	ErrForbidden     = &Error{Type: ErrorTypeForbidden}
+
+	// ErrRateLimited matches the requests rejected by the rate limits, which
+	// are answered outside of the API envelope.
+	ErrRateLimited = &Error{StatusCode: http.StatusTooManyRequests}
+)
+
+// Error is an error answered by the server.
+type Error struct {
+	Type       ErrorType
+	Message    string
+	StatusCode int
+}
+
+func (e *Error) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("server returned HTTP status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Type, e.Message)
+}
+
+// Is matches the errors of the same type, or of the same status code if
+// target has no type.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	if t.Type != "" {
+		return e.Type == t.Type
+	}
+	return t.StatusCode != 0 && e.StatusCode == t.StatusCode
+}
+
+// errorTypeOf returns the error type of the responses answered outside of
+// the API envelope, e.g. by the lifecycle endpoints.
+func errorTypeOf(code int) ErrorType {
+	switch code {
+	case http.StatusBadRequest:
+		return ErrorTypeBadData
+	case http.StatusForbidden:
+		return ErrorTypeForbidden
+	case http.StatusNotFound:
+		return ErrorTypeNotFound
+	case http.StatusNotAcceptable:
+		return ErrorTypeNotAcceptable
+	case http.StatusServiceUnavailable:
+		return ErrorTypeUnavailable
+	case http.StatusTooManyRequests:
+		return ""
+	}
+	if code >= http.StatusInternalServerError {
+		return ErrorTypeInternal
+	}
+	return ""
+}
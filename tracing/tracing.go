@@ -0,0 +1,308 @@
+// Package tracing configures the OpenTelemetry tracer provider used by the
+// instrumented HTTP server and clients.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	commoncfg "github.com/prometheus/common/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/ilolicon/demoapp/config"
+)
+
+const serviceName = "demoapp"
+
+// Manager is capable of building, (re)installing and shutting down
+// the tracer provider.
+type Manager struct {
+	logger   *slog.Logger
+	version  string
+	done     chan struct{}
+	provider *reloadableProvider
+
+	// Protects config and shutdownFunc.
+	mtx          sync.Mutex
+	config       config.TracingConfig
+	shutdownFunc func() error
+}
+
+// NewManager creates a new tracing manager. It installs the global tracer
+// provider, text map propagator and error handler. The actual exporting
+// provider is swapped in and out on configuration changes.
+func NewManager(logger *slog.Logger, version string) *Manager {
+	m := &Manager{
+		logger:   logger,
+		version:  version,
+		done:     make(chan struct{}),
+		provider: &reloadableProvider{},
+	}
+	m.provider.set(noop.NewTracerProvider())
+
+	otel.SetTracerProvider(m.provider)
+	// Propagate W3C trace context and baggage to and from downstream calls.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetErrorHandler(otelErrHandler(func(err error) {
+		m.logger.Error("OpenTelemetry handler returned an error", "err", err)
+	}))
+	return m
+}
+
+// Run blocks until the tracing manager is stopped.
+func (m *Manager) Run() {
+	<-m.done
+}
+
+// ApplyConfig takes care of refreshing the tracing configuration by shutting
+// down the current tracer provider (if any is registered) and installing a new
+// one.
+func (m *Manager) ApplyConfig(cfg *config.Config) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	// Update only if a config change is detected. If TLS configuration is
+	// set, we have to restart the manager to make sure that new TLS
+	// certificates are picked up.
+	var blankTLSConfig commoncfg.TLSConfig
+	if reflect.DeepEqual(m.config, cfg.Tracing) && m.config.TLSConfig == blankTLSConfig {
+		return nil
+	}
+
+	if !cfg.Tracing.Enabled() {
+		m.provider.set(noop.NewTracerProvider())
+		m.shutdown()
+		m.config = cfg.Tracing
+		m.logger.Info("Tracing provider uninstalled.")
+		return nil
+	}
+
+	tp, shutdownFunc, err := buildTracerProvider(context.Background(), cfg.Tracing, m.version)
+	if err != nil {
+		return fmt.Errorf("failed to install a new tracer provider: %w", err)
+	}
+
+	m.provider.set(tp)
+	m.shutdown()
+	m.shutdownFunc = shutdownFunc
+	m.config = cfg.Tracing
+	m.logger.Info("Successfully installed a new tracer provider.", "client_type", cfg.Tracing.ClientType)
+	return nil
+}
+
+// Stop gracefully shuts down the tracer provider and stops the tracing manager.
+func (m *Manager) Stop() {
+	defer close(m.done)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.provider.set(noop.NewTracerProvider())
+	m.shutdown()
+	m.logger.Info("Tracing manager stopped")
+}
+
+func (m *Manager) shutdown() {
+	if m.shutdownFunc == nil {
+		return
+	}
+	if err := m.shutdownFunc(); err != nil {
+		m.logger.Error("failed to shut down the tracer provider", "err", err)
+	}
+	m.shutdownFunc = nil
+}
+
+type otelErrHandler func(err error)
+
+func (o otelErrHandler) Handle(err error) {
+	o(err)
+}
+
+// buildTracerProvider return a new tracer provider ready for installation,
+// together with a shutdown function.
+func buildTracerProvider(ctx context.Context, tracingCfg config.TracingConfig, version string) (trace.TracerProvider, func() error, error) {
+	exporter, closer, err := getExporter(tracingCfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attrs := []attribute.KeyValue{
+		semconv.ServiceNameKey.String(serviceName),
+		semconv.ServiceVersionKey.String(version),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		attrs = append(attrs, semconv.HostNameKey.String(hostname))
+	}
+	// The downward API usually exposes the pod identity as environment variables.
+	if pod := os.Getenv("POD_NAME"); pod != "" {
+		attrs = append(attrs, semconv.K8SPodNameKey.String(pod))
+	}
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		attrs = append(attrs, semconv.K8SNamespaceNameKey.String(ns))
+	}
+	for k, v := range tracingCfg.ResourceAttributes {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+
+	// Create a resource describing the service and the runtime.
+	res, err := resource.New(
+		ctx,
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(attrs...),
+		resource.WithProcessRuntimeDescription(),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		closer()
+		return nil, nil, err
+	}
+
+	tp := tracesdk.NewTracerProvider(
+		tracesdk.WithBatcher(exporter),
+		tracesdk.WithSampler(tracesdk.ParentBased(
+			tracesdk.TraceIDRatioBased(tracingCfg.SamplingFraction),
+		)),
+		tracesdk.WithResource(res),
+	)
+
+	return tp, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := tp.Shutdown(ctx)
+		return errors.Join(err, closer())
+	}, nil
+}
+
+// getExporter return a span exporter according to the provided tracing
+// configuration, together with a function releasing its resources.
+func getExporter(c config.TracingConfig) (tracesdk.SpanExporter, func() error, error) {
+	nopCloser := func() error { return nil }
+	headers := make(map[string]string, len(c.Headers))
+	for k, v := range c.Headers {
+		headers[k] = string(v)
+	}
+
+	switch c.ClientType {
+	case config.TracingClientGRPC:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(c.Endpoint)}
+		if c.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		} else {
+			tlsConf, err := commoncfg.NewTLSConfig(&c.TLSConfig)
+			if err != nil {
+				return nil, nil, err
+			}
+			opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsConf)))
+		}
+		if c.Compression != "" {
+			opts = append(opts, otlptracegrpc.WithCompressor(c.Compression))
+		}
+		if len(c.Headers) > 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(headers))
+		}
+		if c.Timeout != 0 {
+			opts = append(opts, otlptracegrpc.WithTimeout(time.Duration(c.Timeout)))
+		}
+
+		exporter, err := otlptracegrpc.New(context.Background(), opts...)
+		return exporter, nopCloser, err
+	case config.TracingClientHTTP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(c.Endpoint)}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		} else {
+			tlsConf, err := commoncfg.NewTLSConfig(&c.TLSConfig)
+			if err != nil {
+				return nil, nil, err
+			}
+			opts = append(opts, otlptracehttp.WithTLSClientConfig(tlsConf))
+		}
+		if c.Compression == config.TracingCompressionGzip {
+			opts = append(opts, otlptracehttp.WithCompression(otlptracehttp.GzipCompression))
+		}
+		if len(c.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(headers))
+		}
+		if c.Timeout != 0 {
+			opts = append(opts, otlptracehttp.WithTimeout(time.Duration(c.Timeout)))
+		}
+
+		exporter, err := otlptracehttp.New(context.Background(), opts...)
+		return exporter, nopCloser, err
+	case config.TracingClientStdout:
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		return exporter, nopCloser, err
+	case config.TracingClientFile:
+		f, err := os.OpenFile(c.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error opening tracing file: %w", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return exporter, f.Close, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown tracing client type %q", c.ClientType)
+}
+
+// reloadableProvider is a trace.TracerProvider forwarding to the currently
+// installed provider. Instrumentation keeps the tracers it gets at startup,
+// so the global provider itself must never change.
+type reloadableProvider struct {
+	embedded.TracerProvider
+
+	mtx sync.RWMutex
+	tp  trace.TracerProvider
+}
+
+func (p *reloadableProvider) set(tp trace.TracerProvider) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.tp = tp
+}
+
+func (p *reloadableProvider) get() trace.TracerProvider {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.tp
+}
+
+// Tracer implements trace.TracerProvider.
+func (p *reloadableProvider) Tracer(name string, opts ...trace.TracerOption) trace.Tracer {
+	return &reloadableTracer{provider: p, name: name, opts: opts}
+}
+
+type reloadableTracer struct {
+	embedded.Tracer
+
+	provider *reloadableProvider
+	name     string
+	opts     []trace.TracerOption
+}
+
+// Start implements trace.Tracer.
+func (t *reloadableTracer) Start(ctx context.Context, spanName string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return t.provider.get().Tracer(t.name, t.opts...).Start(ctx, spanName, opts...)
+}
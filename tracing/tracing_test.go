@@ -0,0 +1,166 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/promslog"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ilolicon/demoapp/config"
+)
+
+func loadConfig(t *testing.T, s string) *config.Config {
+	t.Helper()
+	cfg, err := config.Load(s)
+	require.NoError(t, err)
+	return cfg
+}
+
+// startSpan records a span with tracer and returns whether it is sampled.
+func startSpan(tracer trace.Tracer, name string) bool {
+	_, span := tracer.Start(context.Background(), name)
+	defer span.End()
+	return span.SpanContext().IsSampled()
+}
+
+func readFile(t *testing.T, filename string) string {
+	t.Helper()
+	b, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestManagerApplyConfig(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.json"), filepath.Join(dir, "second.json")
+
+	m := NewManager(promslog.NewNopLogger(), "1.2.3")
+	// Tracers handed out before a provider is installed follow the reloads.
+	tracer := otel.Tracer("early")
+	require.False(t, startSpan(tracer, "before"))
+
+	require.NoError(t, m.ApplyConfig(loadConfig(t, "tracing: {client_type: file, file: "+first+"}")))
+	require.True(t, startSpan(tracer, "first span"))
+
+	// Applying the same configuration keeps the provider.
+	provider := m.provider.get()
+	require.NoError(t, m.ApplyConfig(loadConfig(t, "tracing: {client_type: file, file: "+first+"}")))
+	require.Same(t, provider, m.provider.get())
+
+	// Reloading shuts the previous provider down, which flushes its spans.
+	require.NoError(t, m.ApplyConfig(loadConfig(t, "tracing: {client_type: file, file: "+second+"}")))
+	require.NotSame(t, provider, m.provider.get())
+	content := readFile(t, first)
+	require.Contains(t, content, `"Name":"first span"`)
+	require.Contains(t, content, `"Value":"1.2.3"`)
+	require.NotContains(t, content, "before")
+	require.True(t, startSpan(tracer, "second span"))
+
+	// Disabling tracing uninstalls the provider.
+	require.NoError(t, m.ApplyConfig(loadConfig(t, "")))
+	require.Contains(t, readFile(t, second), `"Name":"second span"`)
+	require.False(t, startSpan(tracer, "disabled"))
+
+	m.Stop()
+	require.NotContains(t, readFile(t, first)+readFile(t, second), "disabled")
+}
+
+func TestManagerApplyConfigError(t *testing.T) {
+	m := NewManager(promslog.NewNopLogger(), "")
+	defer m.Stop()
+
+	file := filepath.Join(t.TempDir(), "missing", "spans.json")
+	require.Error(t, m.ApplyConfig(loadConfig(t, "tracing: {client_type: file, file: "+file+"}")))
+	require.False(t, startSpan(otel.Tracer("test"), "failed"))
+}
+
+func TestManagerHTTPExport(t *testing.T) {
+	requests := make(chan *http.Request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		requests <- r
+	}))
+	defer srv.Close()
+
+	m := NewManager(promslog.NewNopLogger(), "")
+	require.NoError(t, m.ApplyConfig(loadConfig(t, fmt.Sprintf(`
+tracing:
+  client_type: http
+  endpoint: %s
+  insecure: true
+  headers:
+    Authorization: Bearer token
+`, strings.TrimPrefix(srv.URL, "http://")))))
+	require.True(t, startSpan(otel.Tracer("test"), "exported"))
+	m.Stop()
+
+	select {
+	case r := <-requests:
+		require.Equal(t, "/v1/traces", r.URL.Path)
+		require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+	default:
+		t.Fatal("no span exported")
+	}
+}
+
+func TestGetExporter(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   string
+		expected interface{}
+	}{
+		{
+			name:     "grpc insecure",
+			config:   "tracing: {client_type: grpc, endpoint: localhost:4317, insecure: true}",
+			expected: &otlptrace.Exporter{},
+		},
+		{
+			name:     "grpc tls",
+			config:   "tracing: {client_type: grpc, endpoint: localhost:4317, tls_config: {insecure_skip_verify: true}}",
+			expected: &otlptrace.Exporter{},
+		},
+		{
+			name:     "http",
+			config:   "tracing: {client_type: http, endpoint: localhost:4318, compression: gzip}",
+			expected: &otlptrace.Exporter{},
+		},
+		{
+			name:     "stdout",
+			config:   "tracing: {client_type: stdout}",
+			expected: &stdouttrace.Exporter{},
+		},
+		{
+			name:     "file",
+			config:   "tracing: {client_type: file, file: " + filepath.Join(t.TempDir(), "spans.json") + "}",
+			expected: &stdouttrace.Exporter{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			exporter, closer, err := getExporter(loadConfig(t, tc.config).Tracing)
+			require.NoError(t, err)
+			require.IsType(t, tc.expected, exporter)
+			require.NoError(t, exporter.Shutdown(context.Background()))
+			require.NoError(t, closer())
+		})
+	}
+
+	// The TLS configuration of the OTLP clients is validated.
+	_, _, err := getExporter(loadConfig(t, "tracing: {client_type: grpc, endpoint: localhost:4317, tls_config: {ca_file: missing.pem}}").Tracing)
+	require.Error(t, err)
+	_, _, err = getExporter(config.TracingConfig{ClientType: "zipkin"})
+	require.Error(t, err)
+}
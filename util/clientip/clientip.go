@@ -0,0 +1,160 @@
+// Package clientip resolves the address of the client which sent a request
+// through a chain of trusted reverse proxies.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ParsePrefixes parses a list of CIDR ranges. Plain IP addresses are accepted
+// as single host ranges.
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP address %q: %w", s, err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q: %w", s, err)
+		}
+		// IPv4-mapped ranges match the unmapped addresses.
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// Resolver determines the client address of requests. The forwarding headers
+// are only taken into account if the request was received from a trusted
+// proxy.
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// NewResolver returns a Resolver trusting the proxies within the given CIDR
+// ranges.
+func NewResolver(trustedProxies []string) (*Resolver, error) {
+	trusted, err := ParsePrefixes(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{trusted: trusted}, nil
+}
+
+func (r *Resolver) isTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range r.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client which sent req.
+//
+// If the peer is a trusted proxy, the Forwarded header is used, then
+// X-Forwarded-For and finally X-Real-IP. The hops of the first two are
+// walked from the nearest one and the first address which is not a trusted
+// proxy is the client. The peer address is returned if it is not trusted or
+// if no forwarding header is set. IPv4-mapped IPv6 addresses are returned as
+// IPv4 addresses.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	peer = peer.Unmap()
+	if r == nil || !r.isTrusted(peer) {
+		return peer.String()
+	}
+
+	if hops := forwardedFor(req.Header.Values("Forwarded")); len(hops) > 0 {
+		return r.walk(hops, peer).String()
+	}
+	if hops := splitList(req.Header.Values("X-Forwarded-For")); len(hops) > 0 {
+		return r.walk(hops, peer).String()
+	}
+	if addr, ok := parseNode(req.Header.Get("X-Real-IP")); ok {
+		return addr.Unmap().String()
+	}
+	return peer.String()
+}
+
+// walk returns the first address of hops, from the nearest one, which is not
+// a trusted proxy. The walk stops at the first invalid or obfuscated hop,
+// returning the last valid address.
+func (r *Resolver) walk(hops []string, peer netip.Addr) netip.Addr {
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseNode(hops[i])
+		if !ok {
+			break
+		}
+		client = addr
+		if !r.isTrusted(addr) {
+			break
+		}
+	}
+	return client.Unmap()
+}
+
+// forwardedFor returns the "for" parameters of RFC 7239 Forwarded headers.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, elem := range splitList(values) {
+		for _, pair := range strings.Split(elem, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || !strings.EqualFold(k, "for") {
+				continue
+			}
+			hops = append(hops, strings.Trim(v, `"`))
+		}
+	}
+	return hops
+}
+
+// splitList splits comma separated header values.
+func splitList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
+// parseNode parses an address with an optional port, IPv6 addresses may be
+// enclosed in brackets.
+func parseNode(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return netip.Addr{}, false
+	}
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	return addr, err == nil
+}
@@ -0,0 +1,126 @@
+package clientip
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		expected   string
+	}{
+		{
+			name:       "Untrusted peer ignores headers",
+			remoteAddr: "198.51.100.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.7"}},
+			expected:   "198.51.100.1",
+		},
+		{
+			name:       "Trusted peer without headers",
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "Forwarded header",
+			remoteAddr: "10.0.0.1:1234",
+			headers: map[string][]string{
+				"Forwarded":       {`for=192.0.2.60;proto=http;by=203.0.113.43`},
+				"X-Forwarded-For": {"203.0.113.7"},
+			},
+			expected: "192.0.2.60",
+		},
+		{
+			name:       "Forwarded header with IPv6 and port",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {`for="[2001:db8:cafe::17]:4711"`}},
+			expected:   "2001:db8:cafe::17",
+		},
+		{
+			name:       "X-Forwarded-For skips trusted hops",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4, 203.0.113.7", "10.0.0.2"}},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "X-Forwarded-For with only trusted hops",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			expected:   "10.0.0.3",
+		},
+		{
+			name:       "X-Forwarded-For stops at invalid hop",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.7, unknown, 10.0.0.2"}},
+			expected:   "10.0.0.2",
+		},
+		{
+			name:       "X-Real-IP",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Real-Ip": {"203.0.113.7"}},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "Invalid X-Real-IP",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Real-Ip": {"invalid"}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "IPv4-mapped untrusted peer",
+			remoteAddr: "[::ffff:198.51.100.1]:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.7"}},
+			expected:   "198.51.100.1",
+		},
+		{
+			name:       "IPv4-mapped trusted peer without headers",
+			remoteAddr: "[::ffff:10.0.0.1]:1234",
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "IPv4-mapped trusted peer and hops",
+			remoteAddr: "[::ffff:10.0.0.1]:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"::ffff:203.0.113.7, ::ffff:10.0.0.2"}},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "IPv4-mapped X-Real-IP",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Real-Ip": {"::ffff:203.0.113.7"}},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "Unix domain socket peer",
+			remoteAddr: "@",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.7"}},
+			expected:   "@",
+		},
+	}
+
+	r, err := NewResolver([]string{"10.0.0.0/8", "::1"})
+	require.NoError(t, err)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &http.Request{RemoteAddr: tc.remoteAddr, Header: http.Header(tc.headers)}
+			require.Equal(t, tc.expected, r.ClientIP(req))
+		})
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := ParsePrefixes([]string{"10.1.2.3/8", "192.0.2.1", "2001:db8::1", "::ffff:10.0.0.0/104", "::ffff:192.0.2.1"})
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.0/8", prefixes[0].String())
+	require.Equal(t, "192.0.2.1/32", prefixes[1].String())
+	require.Equal(t, "2001:db8::1/128", prefixes[2].String())
+	require.Equal(t, "10.0.0.0/8", prefixes[3].String())
+	require.Equal(t, "192.0.2.1/32", prefixes[4].String())
+
+	_, err = ParsePrefixes([]string{"10.0.0.0/33"})
+	require.Error(t, err)
+}
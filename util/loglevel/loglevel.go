@@ -0,0 +1,190 @@
+// Package loglevel provides logging levels which can be changed at runtime,
+// both globally and per component.
+package loglevel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ComponentKey is the attribute key identifying the component of a logger.
+const ComponentKey = "component"
+
+// Options lists the accepted logging levels.
+var Options = []string{"debug", "info", "warn", "error"}
+
+// Parse returns the slog.Level of the given level name.
+func Parse(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unrecognized log level %q", s)
+}
+
+func levelString(l slog.Level) string {
+	return strings.ToLower(l.String())
+}
+
+type componentLevel struct {
+	level slog.LevelVar
+	set   atomic.Bool // false if the component uses the root level.
+}
+
+// Levels holds the root logging level and the per-component overrides.
+type Levels struct {
+	initial slog.Level
+	root    slog.LevelVar
+
+	mtx        sync.Mutex
+	components map[string]*componentLevel
+}
+
+// New returns Levels with the given initial root level.
+func New(initial string) (*Levels, error) {
+	lvl, err := Parse(initial)
+	if err != nil {
+		return nil, err
+	}
+	l := &Levels{
+		initial:    lvl,
+		components: map[string]*componentLevel{},
+	}
+	l.root.Set(lvl)
+	return l, nil
+}
+
+// Handler wraps h so that records are filtered by the root level, or by the
+// level of the component set with the ComponentKey attribute.
+func (l *Levels) Handler(h slog.Handler) slog.Handler {
+	return &handler{Handler: h, levels: l}
+}
+
+func (l *Levels) component(name string) *componentLevel {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	c, ok := l.components[name]
+	if !ok {
+		c = &componentLevel{}
+		l.components[name] = c
+	}
+	return c
+}
+
+// Level returns the root level.
+func (l *Levels) Level() string {
+	return levelString(l.root.Level())
+}
+
+// SetLevel sets the root level.
+func (l *Levels) SetLevel(s string) error {
+	lvl, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	l.root.Set(lvl)
+	return nil
+}
+
+// Toggle switches the root level between debug and the initial level, or
+// info if the initial level is debug. It returns the new level.
+func (l *Levels) Toggle() string {
+	next := slog.LevelDebug
+	if l.root.Level() == slog.LevelDebug {
+		next = l.initial
+		if next == slog.LevelDebug {
+			next = slog.LevelInfo
+		}
+	}
+	l.root.Set(next)
+	return levelString(next)
+}
+
+// ToggleOnSignal toggles the root level for every signal received on
+// signals until done is closed. The new level is logged with logger.
+func (l *Levels) ToggleOnSignal(signals <-chan os.Signal, done <-chan struct{}, logger *slog.Logger) {
+	for {
+		select {
+		case sig := <-signals:
+			logger.Warn("Received signal, toggled log level", "signal", sig, "level", l.Toggle())
+		case <-done:
+			return
+		}
+	}
+}
+
+// ComponentLevels returns the effective level of every known component.
+func (l *Levels) ComponentLevels() map[string]string {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	levels := make(map[string]string, len(l.components))
+	for name, c := range l.components {
+		levels[name] = levelString(l.effective(c))
+	}
+	return levels
+}
+
+// SetComponentLevel overrides the level of the given component. An empty
+// level makes the component follow the root level again.
+func (l *Levels) SetComponentLevel(component, s string) error {
+	if component == "" {
+		return errors.New("empty component name")
+	}
+	c := l.component(component)
+	if s == "" {
+		c.set.Store(false)
+		return nil
+	}
+	lvl, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	c.level.Set(lvl)
+	c.set.Store(true)
+	return nil
+}
+
+func (l *Levels) effective(c *componentLevel) slog.Level {
+	if c != nil && c.set.Load() {
+		return c.level.Level()
+	}
+	return l.root.Level()
+}
+
+type handler struct {
+	slog.Handler
+	levels    *Levels
+	component *componentLevel
+}
+
+func (h *handler) Enabled(_ context.Context, lvl slog.Level) bool {
+	return lvl >= h.levels.effective(h.component)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := h.component
+	for _, a := range attrs {
+		if a.Key == ComponentKey {
+			c = h.levels.component(a.Value.String())
+		}
+	}
+	return &handler{Handler: h.Handler.WithAttrs(attrs), levels: h.levels, component: c}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{Handler: h.Handler.WithGroup(name), levels: h.levels, component: h.component}
+}
@@ -0,0 +1,86 @@
+package loglevel
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestComponentLevels(t *testing.T) {
+	levels, err := New("info")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	logger := slog.New(levels.Handler(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	web := logger.With(ComponentKey, "web")
+	ctx := context.Background()
+
+	require.False(t, web.Enabled(ctx, slog.LevelDebug))
+	require.Equal(t, map[string]string{"web": "info"}, levels.ComponentLevels())
+
+	require.NoError(t, levels.SetComponentLevel("web", "debug"))
+	require.True(t, web.Enabled(ctx, slog.LevelDebug))
+	require.False(t, logger.Enabled(ctx, slog.LevelDebug))
+	web.Debug("visible")
+	logger.Debug("hidden")
+	require.Contains(t, buf.String(), "visible")
+	require.NotContains(t, buf.String(), "hidden")
+
+	// Components without override follow the root level.
+	require.NoError(t, levels.SetLevel("error"))
+	require.Equal(t, "error", levels.Level())
+	require.True(t, web.Enabled(ctx, slog.LevelDebug))
+	require.NoError(t, levels.SetComponentLevel("web", ""))
+	require.False(t, web.Enabled(ctx, slog.LevelWarn))
+	require.Equal(t, map[string]string{"web": "error"}, levels.ComponentLevels())
+
+	require.Error(t, levels.SetLevel("verbose"))
+	require.Error(t, levels.SetComponentLevel("web", "verbose"))
+	require.Error(t, levels.SetComponentLevel("", "debug"))
+	_, err = New("verbose")
+	require.Error(t, err)
+}
+
+func TestToggle(t *testing.T) {
+	for initial, expected := range map[string][]string{
+		"warn":  {"debug", "warn", "debug"},
+		"debug": {"info", "debug", "info"},
+	} {
+		levels, err := New(initial)
+		require.NoError(t, err)
+		var toggled []string
+		for range expected {
+			toggled = append(toggled, levels.Toggle())
+		}
+		require.Equal(t, expected, toggled, "initial level %s", initial)
+	}
+}
+
+func TestToggleOnSignal(t *testing.T) {
+	levels, err := New("info")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	signals, done := make(chan os.Signal), make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		levels.ToggleOnSignal(signals, done, slog.New(slog.NewTextHandler(&buf, nil)))
+		close(stopped)
+	}()
+
+	signals <- syscall.SIGUSR1
+	require.Eventually(t, func() bool { return levels.Level() == "debug" }, 5*time.Second, 10*time.Millisecond)
+	signals <- syscall.SIGUSR1
+	require.Eventually(t, func() bool { return levels.Level() == "info" }, 5*time.Second, 10*time.Millisecond)
+
+	close(done)
+	<-stopped
+	require.Equal(t, 2, strings.Count(buf.String(), "toggled log level"))
+}
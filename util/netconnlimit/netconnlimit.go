@@ -18,48 +18,320 @@
 package netconnlimit
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-// NewSharedSemaphore creates and returns a new semaphore channel that can be used
+// RejectMode defines how connections over the limits are turned away.
+type RejectMode string
+
+const (
+	// RejectClose closes over-limit connections right away.
+	RejectClose RejectMode = "close"
+	// RejectHTTP503 answers over-limit connections with a plain HTTP/1.1
+	// 503 response before closing them. It is only meaningful for listeners
+	// serving plain text HTTP.
+	RejectHTTP503 RejectMode = "503"
+)
+
+// RejectModes lists the accepted values of RejectMode.
+var RejectModes = []string{string(RejectClose), string(RejectHTTP503)}
+
+// rejectWriteTimeout bounds the time spent writing the 503 response.
+const rejectWriteTimeout = time.Second
+
+// Metrics about the connections of limited listeners.
+type Metrics struct {
+	waiting  *prometheus.GaugeVec
+	rejected *prometheus.CounterVec
+	inUse    *prometheus.GaugeVec
+
+	reservedInUse *prometheus.GaugeVec
+}
+
+// NewMetrics creates the connection limit metrics and registers them with r
+// if it isn't nil.
+func NewMetrics(r prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		waiting: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "demoapp_connections_waiting",
+				Help: "Number of accepted connections waiting for a connection slot.",
+			},
+			[]string{"listener"},
+		),
+		rejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "demoapp_connections_rejected_total",
+				Help: "Total number of connections rejected by the connection limits.",
+			},
+			[]string{"listener", "reason"},
+		),
+		inUse: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "demoapp_connections_in_use",
+				Help: "Number of connection slots in use.",
+			},
+			[]string{"listener"},
+		),
+		reservedInUse: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "demoapp_connections_reserved_in_use",
+				Help: "Number of reserved connection slots in use.",
+			},
+			[]string{"listener"},
+		),
+	}
+	if r != nil {
+		r.MustRegister(m.waiting, m.rejected, m.inUse, m.reservedInUse)
+	}
+	return m
+}
+
+// Option configures a listener returned by SharedLimitListener.
+type Option func(*options)
+
+type options struct {
+	maxPerIP       int
+	acquireTimeout time.Duration
+	rejectMode     RejectMode
+	reserved       *Reserved
+
+	waiting       prometheus.Gauge
+	inUse         prometheus.Gauge
+	reservedInUse prometheus.Gauge
+	rejected      func(reason string) prometheus.Counter
+}
+
+// WithMaxPerIP limits the number of simultaneous connections from a single
+// peer IP address. Connections over the limit are rejected. 0 disables the
+// limit.
+func WithMaxPerIP(n int) Option {
+	return func(o *options) { o.maxPerIP = n }
+}
+
+// WithAcquireTimeout rejects connections which could not get a slot of the
+// shared semaphore within d. 0 waits indefinitely.
+func WithAcquireTimeout(d time.Duration) Option {
+	return func(o *options) { o.acquireTimeout = d }
+}
+
+// WithRejectMode sets how over-limit connections are turned away, they are
+// closed by default.
+func WithRejectMode(mode RejectMode) Option {
+	return func(o *options) { o.rejectMode = mode }
+}
+
+// WithReserved lets priority connections use the slots of r when the shared
+// semaphore is full.
+func WithReserved(r *Reserved) Option {
+	return func(o *options) { o.reserved = r }
+}
+
+// WithMetrics reports the connections of the listener in m with the given
+// listener label.
+func WithMetrics(m *Metrics, listener string) Option {
+	return func(o *options) {
+		o.waiting = m.waiting.WithLabelValues(listener)
+		o.inUse = m.inUse.WithLabelValues(listener)
+		o.reservedInUse = m.reservedInUse.WithLabelValues(listener)
+		o.rejected = func(reason string) prometheus.Counter {
+			return m.rejected.WithLabelValues(listener, reason)
+		}
+		for _, reason := range []string{"per_ip", "timeout"} {
+			m.rejected.WithLabelValues(listener, reason)
+		}
+	}
+}
+
+// Semaphore limits the number of simultaneous connections across multiple
+// listeners. Its size can be changed while slots are held: growing it admits
+// waiting connections right away, shrinking it lets the connections in use
+// complete and only holds back new ones.
+type Semaphore struct {
+	mtx     sync.Mutex
+	size    int
+	inUse   int
+	changed chan struct{} // Closed and replaced when a slot may have become available.
+}
+
+// NewSharedSemaphore creates and returns a new semaphore that can be used
 // to limit the number of simultaneous connections across multiple listeners.
-func NewSharedSemaphore(n int) chan struct{} {
-	return make(chan struct{}, n)
+func NewSharedSemaphore(n int) *Semaphore {
+	return &Semaphore{size: n, changed: make(chan struct{})}
+}
+
+// TryAcquire acquires a slot without blocking. Returns false if none is
+// available.
+func (s *Semaphore) TryAcquire() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.inUse >= s.size {
+		return false
+	}
+	s.inUse++
+	return true
+}
+
+// Acquire blocks until a slot is available or ctx is done, in which case the
+// context error is returned.
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	for {
+		s.mtx.Lock()
+		if s.inUse < s.size {
+			s.inUse++
+			s.mtx.Unlock()
+			return nil
+		}
+		changed := s.changed
+		s.mtx.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Release releases a slot acquired with Acquire or TryAcquire.
+func (s *Semaphore) Release() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.inUse--
+	s.notify()
+}
+
+// Resize changes the number of slots of the semaphore.
+func (s *Semaphore) Resize(n int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.size = n
+	s.notify()
+}
+
+// notify wakes up the waiters, it must be called with the lock held.
+func (s *Semaphore) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// InUse returns the number of slots in use. It can exceed the size after the
+// semaphore was shrunk.
+func (s *Semaphore) InUse() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.inUse
+}
+
+// Size returns the number of slots of the semaphore.
+func (s *Semaphore) Size() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.size
 }
 
 // SharedLimitListener returns a listener that accepts at most n simultaneous
 // connections across multiple listeners using the provided shared semaphore.
-func SharedLimitListener(l net.Listener, sem chan struct{}) net.Listener {
+//
+// Without a per-IP limit, an acquire timeout or reserved slots, Accept blocks
+// until a slot is available and pending connections wait in the kernel
+// backlog. Otherwise connections are accepted right away and turned away
+// according to the reject mode when they are over the limits. At most as many
+// connections as there are shared and reserved slots wait for a slot, further
+// ones wait in the kernel backlog.
+func SharedLimitListener(l net.Listener, sem *Semaphore, opts ...Option) net.Listener {
+	o := options{rejectMode: RejectClose}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &sharedLimitListener{
 		Listener: l,
 		sem:      sem,
-		done:     make(chan struct{}),
+		opts:     o,
+		async:    o.maxPerIP > 0 || o.acquireTimeout > 0 || o.reserved != nil,
+		perIP:    map[string]int{},
+		conns:    make(chan acceptResult),
+		admitted: make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
 	}
 }
 
 type sharedLimitListener struct {
 	net.Listener
-	sem       chan struct{}
-	closeOnce sync.Once     // Ensures the done chan is only closed once.
-	done      chan struct{} // No values sent; closed when Close is called.
+	sem    *Semaphore
+	opts   options
+	ctx    context.Context // Canceled when Close is called.
+	cancel context.CancelFunc
+
+	// async listeners accept connections in the background and hand the
+	// ones within the limits over to Accept.
+	async     bool
+	startOnce sync.Once
+	conns     chan acceptResult
+
+	mtx   sync.Mutex
+	perIP map[string]int
+	// admitting counts the connections accepted in the background which
+	// are not handed over or rejected yet.
+	admitting int
+	admitted  chan struct{} // Signaled when admitting was decremented.
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
 }
 
 // Acquire acquires the shared semaphore. Returns true if successfully
-// acquired, false if the listener is closed and the semaphore is not
-// acquired.
+// acquired, false if the listener is closed or the acquire timeout expired
+// and the semaphore is not acquired.
 func (l *sharedLimitListener) acquire() bool {
-	select {
-	case <-l.done:
-		return false
-	case l.sem <- struct{}{}:
+	if l.sem.TryAcquire() {
+		l.inc(l.opts.inUse)
 		return true
 	}
+
+	l.inc(l.opts.waiting)
+	defer l.dec(l.opts.waiting)
+
+	ctx := l.ctx
+	if l.opts.acquireTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.opts.acquireTimeout)
+		defer cancel()
+	}
+	if err := l.sem.Acquire(ctx); err != nil {
+		return false
+	}
+	l.inc(l.opts.inUse)
+	return true
 }
 
-func (l *sharedLimitListener) release() { <-l.sem }
+func (l *sharedLimitListener) release() {
+	l.sem.Release()
+	l.dec(l.opts.inUse)
+}
 
 func (l *sharedLimitListener) Accept() (net.Conn, error) {
+	if l.async {
+		l.startOnce.Do(func() { go l.acceptLoop() })
+		select {
+		case res := <-l.conns:
+			return res.conn, res.err
+		case <-l.ctx.Done():
+			return nil, net.ErrClosed
+		}
+	}
+
 	if !l.acquire() {
 		for {
 			c, err := l.Listener.Accept()
@@ -78,12 +350,215 @@ func (l *sharedLimitListener) Accept() (net.Conn, error) {
 	return &sharedLimitListenerConn{Conn: c, release: l.release}, nil
 }
 
+// limited returns whether connections must be accepted before they get a
+// slot, to enforce the per-IP limit, the acquire timeout or the reservations.
+func (l *sharedLimitListener) limited() bool {
+	return l.opts.maxPerIP > 0 || l.opts.acquireTimeout > 0 ||
+		(l.opts.reserved != nil && l.opts.reserved.Slots() > 0)
+}
+
+// acceptLoop accepts connections until the listener is closed and admits
+// each of them in its own goroutine. At most maxAdmitting connections are
+// admitted at a time, further ones wait in the kernel backlog.
+func (l *sharedLimitListener) acceptLoop() {
+	for {
+		// Leave the pending connections in the kernel backlog when there are
+		// no reserved slots, like synchronous listeners.
+		acquired := !l.limited()
+		if acquired && !l.acquire() {
+			return
+		}
+		if !acquired && !l.startAdmit() {
+			return
+		}
+
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if acquired {
+				l.release()
+			} else {
+				l.doneAdmit()
+			}
+			select {
+			case l.conns <- acceptResult{err: err}:
+			case <-l.ctx.Done():
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		if acquired {
+			l.handOver(&sharedLimitListenerConn{Conn: c, release: l.release})
+			continue
+		}
+		go l.admit(c)
+	}
+}
+
+// maxAdmitting returns the maximum number of connections admitted at a time:
+// one per slot of the shared semaphore and of the reservations.
+func (l *sharedLimitListener) maxAdmitting() int {
+	n := l.sem.Size()
+	if l.opts.reserved != nil {
+		n += l.opts.reserved.Slots()
+	}
+	return max(n, 1)
+}
+
+// startAdmit blocks until fewer than maxAdmitting connections are admitted
+// and counts a new one. Returns false if the listener is closed.
+func (l *sharedLimitListener) startAdmit() bool {
+	for {
+		l.mtx.Lock()
+		if l.admitting < l.maxAdmitting() {
+			l.admitting++
+			l.mtx.Unlock()
+			return true
+		}
+		l.mtx.Unlock()
+
+		select {
+		case <-l.admitted:
+		case <-l.ctx.Done():
+			return false
+		}
+	}
+}
+
+func (l *sharedLimitListener) doneAdmit() {
+	l.mtx.Lock()
+	l.admitting--
+	l.mtx.Unlock()
+	select {
+	case l.admitted <- struct{}{}:
+	default:
+	}
+}
+
+// admit hands c over to Accept once it is within the limits, or rejects it.
+func (l *sharedLimitListener) admit(c net.Conn) {
+	defer l.doneAdmit()
+
+	ip := peerIP(c)
+	if !l.acquireIP(ip) {
+		l.reject(c, "per_ip")
+		return
+	}
+
+	acquired := l.sem.TryAcquire()
+	if acquired {
+		l.inc(l.opts.inUse)
+	} else if l.opts.reserved != nil {
+		// Priority connections take a reserved slot when the shared
+		// semaphore is full.
+		var reserved bool
+		if c, reserved = l.opts.reserved.acquire(c); reserved {
+			l.inc(l.opts.reservedInUse)
+			l.handOver(&sharedLimitListenerConn{Conn: c, release: func() {
+				l.opts.reserved.release()
+				l.dec(l.opts.reservedInUse)
+				l.releaseIP(ip)
+			}})
+			return
+		}
+	}
+
+	if !acquired && !l.acquire() {
+		l.releaseIP(ip)
+		if l.ctx.Err() != nil {
+			c.Close()
+		} else {
+			l.reject(c, "timeout")
+		}
+		return
+	}
+	l.handOver(&sharedLimitListenerConn{Conn: c, release: func() {
+		l.release()
+		l.releaseIP(ip)
+	}})
+}
+
+// handOver passes conn to Accept, or closes it if the listener is closed.
+func (l *sharedLimitListener) handOver(conn net.Conn) {
+	select {
+	case l.conns <- acceptResult{conn: conn}:
+	case <-l.ctx.Done():
+		conn.Close()
+	}
+}
+
+// acquireIP counts a connection from ip. Returns false if the per-IP limit
+// is reached.
+func (l *sharedLimitListener) acquireIP(ip string) bool {
+	if l.opts.maxPerIP <= 0 || ip == "" {
+		return true
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.perIP[ip] >= l.opts.maxPerIP {
+		return false
+	}
+	l.perIP[ip]++
+	return true
+}
+
+func (l *sharedLimitListener) releaseIP(ip string) {
+	if l.opts.maxPerIP <= 0 || ip == "" {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+func (l *sharedLimitListener) reject(c net.Conn, reason string) {
+	if l.opts.rejected != nil {
+		l.opts.rejected(reason).Inc()
+	}
+	if l.opts.rejectMode == RejectHTTP503 {
+		body := "Too many connections\n"
+		c.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+		fmt.Fprintf(c, "HTTP/1.1 503 Service Unavailable\r\n"+
+			"Content-Type: text/plain; charset=utf-8\r\n"+
+			"Content-Length: %d\r\n"+
+			"Connection: close\r\n\r\n%s", len(body), body)
+	}
+	c.Close()
+}
+
+func (l *sharedLimitListener) inc(g prometheus.Gauge) {
+	if g != nil {
+		g.Inc()
+	}
+}
+
+func (l *sharedLimitListener) dec(g prometheus.Gauge) {
+	if g != nil {
+		g.Dec()
+	}
+}
+
 func (l *sharedLimitListener) Close() error {
 	err := l.Listener.Close()
-	l.closeOnce.Do(func() { close(l.done) })
+	l.cancel()
 	return err
 }
 
+// peerIP returns the IP address of the peer of c, or an empty string if it
+// doesn't have one.
+func peerIP(c net.Conn) string {
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	return addr.IP.String()
+}
+
 type sharedLimitListenerConn struct {
 	net.Conn
 	releaseOnce sync.Once
@@ -13,12 +13,14 @@
 package netconnlimit
 
 import (
+	"context"
 	"io"
 	"net"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -100,7 +102,7 @@ func TestSharedLimitListenerConcurrency(t *testing.T) {
 			wg.Wait()
 
 			// Ensure all connections are released and semaphore is empty.
-			require.Empty(t, sem)
+			require.Zero(t, sem.InUse())
 		})
 	}
 }
@@ -122,3 +124,215 @@ func TestSharedLimitListenerClose(t *testing.T) {
 		conn.Close()
 	}
 }
+
+func TestSharedLimitListenerMaxPerIP(t *testing.T) {
+	sem := NewSharedSemaphore(10)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "failed to create listener")
+
+	m := NewMetrics(nil)
+	limitedListener := SharedLimitListener(listener, sem, WithMaxPerIP(1), WithMetrics(m, "test"))
+	defer limitedListener.Close()
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "failed to connect to listener")
+	defer first.Close()
+
+	conn, err := limitedListener.Accept()
+	require.NoError(t, err, "failed to accept connection")
+
+	// The second connection from the same address is closed right away.
+	second, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "failed to connect to listener")
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, 1.0, testutil.ToFloat64(m.rejected.WithLabelValues("test", "per_ip")))
+
+	// Closing the first connection frees the slot of the address.
+	require.NoError(t, conn.Close())
+	require.Zero(t, sem.InUse())
+
+	third, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "failed to connect to listener")
+	defer third.Close()
+	conn, err = limitedListener.Accept()
+	require.NoError(t, err, "failed to accept connection")
+	require.Equal(t, 1.0, testutil.ToFloat64(m.inUse.WithLabelValues("test")))
+	conn.Close()
+}
+
+func TestSharedLimitListenerAcquireTimeout(t *testing.T) {
+	sem := NewSharedSemaphore(1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "failed to create listener")
+
+	m := NewMetrics(nil)
+	limitedListener := SharedLimitListener(listener, sem,
+		WithAcquireTimeout(50*time.Millisecond),
+		WithRejectMode(RejectHTTP503),
+		WithMetrics(m, "test"),
+	)
+	defer limitedListener.Close()
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "failed to connect to listener")
+	defer first.Close()
+
+	conn, err := limitedListener.Accept()
+	require.NoError(t, err, "failed to accept connection")
+	defer conn.Close()
+
+	// The second connection doesn't get a slot in time and is answered
+	// with a 503 response.
+	second, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "failed to connect to listener")
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := io.ReadAll(second)
+	require.NoError(t, err)
+	require.Contains(t, string(resp), "HTTP/1.1 503 Service Unavailable")
+	require.Equal(t, 1.0, testutil.ToFloat64(m.rejected.WithLabelValues("test", "timeout")))
+	require.Equal(t, 0.0, testutil.ToFloat64(m.waiting.WithLabelValues("test")))
+}
+
+func TestSemaphoreResize(t *testing.T) {
+	sem := NewSharedSemaphore(1)
+	require.True(t, sem.TryAcquire())
+	require.False(t, sem.TryAcquire())
+
+	// Growing the semaphore admits the waiters.
+	acquired := make(chan error)
+	go func() { acquired <- sem.Acquire(context.Background()) }()
+	sem.Resize(2)
+	require.NoError(t, <-acquired)
+	require.Equal(t, 2, sem.InUse())
+
+	// Shrinking the semaphore keeps the slots in use.
+	sem.Resize(1)
+	require.Equal(t, 2, sem.InUse())
+	sem.Release()
+	require.False(t, sem.TryAcquire())
+	sem.Release()
+	require.True(t, sem.TryAcquire())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, sem.Acquire(ctx), context.DeadlineExceeded)
+}
+
+func TestSharedLimitListenerReserved(t *testing.T) {
+	sem := NewSharedSemaphore(1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "failed to create listener")
+
+	reserved := NewReserved()
+	reserved.Update(1, nil, nil, []string{"/-/healthy"})
+	limitedListener := SharedLimitListener(listener, sem, WithReserved(reserved), WithAcquireTimeout(50*time.Millisecond))
+	defer limitedListener.Close()
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "failed to connect to listener")
+	defer first.Close()
+	conn, err := limitedListener.Accept()
+	require.NoError(t, err, "failed to accept connection")
+	defer conn.Close()
+
+	// The probe gets a reserved slot and its request line is replayed.
+	probe, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "failed to connect to listener")
+	defer probe.Close()
+	request := "GET /-/healthy HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	_, err = io.WriteString(probe, request)
+	require.NoError(t, err)
+
+	probeConn, err := limitedListener.Accept()
+	require.NoError(t, err, "failed to accept probe connection")
+	require.Equal(t, 1, reserved.InUse())
+	buf := make([]byte, len(request))
+	_, err = io.ReadFull(probeConn, buf)
+	require.NoError(t, err)
+	require.Equal(t, request, string(buf))
+	probeConn.Close()
+	require.Zero(t, reserved.InUse())
+
+	// Other requests wait for the shared semaphore.
+	other, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err, "failed to connect to listener")
+	defer other.Close()
+	_, err = io.WriteString(other, "GET /echo HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = other.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+// countingListener counts the connections accepted by the wrapped listener.
+type countingListener struct {
+	net.Listener
+	mtx      sync.Mutex
+	accepted int
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.mtx.Lock()
+		l.accepted++
+		l.mtx.Unlock()
+	}
+	return c, err
+}
+
+func (l *countingListener) Accepted() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.accepted
+}
+
+func TestSharedLimitListenerAdmitBounded(t *testing.T) {
+	sem := NewSharedSemaphore(2)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "failed to create listener")
+	counting := &countingListener{Listener: listener}
+
+	m := NewMetrics(nil)
+	limitedListener := SharedLimitListener(counting, sem, WithMaxPerIP(100), WithMetrics(m, "test"))
+	defer limitedListener.Close()
+
+	// Fill the pool.
+	var pool []net.Conn
+	for range 2 {
+		c, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err, "failed to connect to listener")
+		defer c.Close()
+		conn, err := limitedListener.Accept()
+		require.NoError(t, err, "failed to accept connection")
+		defer conn.Close()
+		pool = append(pool, conn)
+	}
+
+	// Flood the full pool: only as many connections as there are slots are
+	// accepted to wait for one, the others stay in the kernel backlog.
+	for range 20 {
+		c, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err, "failed to connect to listener")
+		defer c.Close()
+	}
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(m.waiting.WithLabelValues("test")) == 2
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 4, counting.Accepted())
+
+	// A freed slot hands a waiting connection over and lets the next one
+	// from the backlog wait.
+	require.NoError(t, pool[0].Close())
+	conn, err := limitedListener.Accept()
+	require.NoError(t, err, "failed to accept connection")
+	defer conn.Close()
+	require.Eventually(t, func() bool {
+		return counting.Accepted() == 5
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,151 @@
+package netconnlimit
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// peekTimeout bounds the time spent reading the first request line of a
+// connection to match it against the reserved paths.
+const peekTimeout = time.Second
+
+// Reserved is a pool of connection slots kept for priority traffic, e.g.
+// health probes. A connection takes a reserved slot when the shared semaphore
+// is full and it comes from a reserved source range, arrives on a reserved
+// local port or starts with a request line for a reserved path. The paths
+// can only be matched on plain text HTTP/1.x listeners.
+type Reserved struct {
+	mtx   sync.RWMutex
+	sem   *Semaphore
+	cidrs []netip.Prefix
+	ports []int
+	paths []string
+}
+
+// NewReserved returns a Reserved pool without slots.
+func NewReserved() *Reserved {
+	return &Reserved{sem: NewSharedSemaphore(0)}
+}
+
+// Update sets the number of reserved slots and the connections allowed to
+// use them. The paths are path.Match patterns.
+func (r *Reserved) Update(slots int, cidrs []netip.Prefix, ports []int, paths []string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.sem.Resize(slots)
+	r.cidrs, r.ports, r.paths = cidrs, ports, paths
+}
+
+// Slots returns the number of reserved slots.
+func (r *Reserved) Slots() int {
+	return r.sem.Size()
+}
+
+// InUse returns the number of reserved slots in use.
+func (r *Reserved) InUse() int {
+	return r.sem.InUse()
+}
+
+// acquire tries to take a reserved slot for c. It returns the connection to
+// use in place of c, which is different if its first bytes were read, and
+// whether a slot was acquired.
+func (r *Reserved) acquire(c net.Conn) (net.Conn, bool) {
+	r.mtx.RLock()
+	cidrs, ports, paths := r.cidrs, r.ports, r.paths
+	r.mtx.RUnlock()
+
+	if r.sem.Size() == 0 {
+		return c, false
+	}
+
+	matched := matchAddr(c.RemoteAddr(), cidrs, nil) || matchAddr(c.LocalAddr(), nil, ports)
+	if !matched && len(paths) > 0 {
+		var p string
+		c, p = peekPath(c)
+		for _, pattern := range paths {
+			if ok, _ := path.Match(pattern, p); ok {
+				matched = true
+				break
+			}
+		}
+	}
+	if !matched {
+		return c, false
+	}
+	return c, r.sem.TryAcquire()
+}
+
+func (r *Reserved) release() {
+	r.sem.Release()
+}
+
+// matchAddr returns whether the IP address of addr is within cidrs or its
+// port is one of ports.
+func matchAddr(addr net.Addr, cidrs []netip.Prefix, ports []int) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+	for _, p := range cidrs {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	for _, port := range ports {
+		if tcpAddr.Port == port {
+			return true
+		}
+	}
+	return false
+}
+
+// peekPath reads the request line sent on c and returns its path together
+// with a connection replaying the bytes read. The path is empty if the
+// request line couldn't be read.
+func peekPath(c net.Conn) (net.Conn, string) {
+	br := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(peekTimeout))
+
+	var line []byte
+	for n := 1; n <= br.Size(); n++ {
+		b, err := br.Peek(n)
+		if err != nil || b[n-1] == '\n' {
+			line = b
+			break
+		}
+	}
+	c.SetReadDeadline(time.Time{})
+
+	// Replay the buffered bytes without the read error, if any.
+	buffered, _ := br.Peek(br.Buffered())
+	pc := &peekedConn{Conn: c, r: io.MultiReader(bytes.NewReader(buffered), c)}
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		return pc, ""
+	}
+
+	// Request line: method SP request-target SP HTTP-version.
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 {
+		return pc, ""
+	}
+	target, _, _ := strings.Cut(fields[1], "?")
+	return pc, target
+}
+
+// peekedConn is a connection whose first bytes were buffered.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
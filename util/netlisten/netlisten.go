@@ -0,0 +1,168 @@
+// Package netlisten creates the stream listeners of the demoapp servers from
+// their listen addresses.
+package netlisten
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// UnixPrefix is the prefix of Unix domain socket listen addresses.
+const UnixPrefix = "unix://"
+
+// Listen announces on the given address. Addresses of the form
+// unix://<path>[?mode=0660&owner=<user>&group=<group>] listen on a Unix
+// domain socket, a path starting with "@" names a socket in the Linux
+// abstract namespace. Any other address listens on TCP.
+func Listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, UnixPrefix) {
+		return net.Listen("tcp", address)
+	}
+
+	path, query, _ := strings.Cut(strings.TrimPrefix(address, UnixPrefix), "?")
+	if path == "" {
+		return nil, fmt.Errorf("missing socket path in %q", address)
+	}
+	opts, err := parseSocketOptions(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket options in %q: %w", address, err)
+	}
+
+	if strings.HasPrefix(path, "@") {
+		if opts.isSet() {
+			return nil, fmt.Errorf("socket options are not supported on abstract socket %q", address)
+		}
+		return net.Listen("unix", path)
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	// The ownership and mode are changed once the socket is created. The
+	// umask is left alone as it applies to the whole process.
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.apply(path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+type socketOptions struct {
+	mode     os.FileMode
+	hasMode  bool
+	uid, gid int
+}
+
+func (o socketOptions) isSet() bool {
+	return o.hasMode || o.uid != -1 || o.gid != -1
+}
+
+func parseSocketOptions(query string) (socketOptions, error) {
+	opts := socketOptions{uid: -1, gid: -1}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return opts, err
+	}
+
+	for k := range values {
+		switch k {
+		case "mode", "owner", "group":
+		default:
+			return opts, fmt.Errorf("unknown option %q", k)
+		}
+	}
+
+	if s := values.Get("mode"); s != "" {
+		m, err := strconv.ParseUint(s, 8, 32)
+		if err != nil {
+			return opts, fmt.Errorf("invalid mode %q: %w", s, err)
+		}
+		opts.mode, opts.hasMode = os.FileMode(m), true
+	}
+	if s := values.Get("owner"); s != "" {
+		if opts.uid, err = lookupID(s, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		}); err != nil {
+			return opts, fmt.Errorf("invalid owner %q: %w", s, err)
+		}
+	}
+	if s := values.Get("group"); s != "" {
+		if opts.gid, err = lookupID(s, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		}); err != nil {
+			return opts, fmt.Errorf("invalid group %q: %w", s, err)
+		}
+	}
+	return opts, nil
+}
+
+// lookupID returns s if it is numeric, or the ID of the user or group named s.
+func lookupID(s string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	id, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+func (o socketOptions) apply(path string) error {
+	if o.uid != -1 || o.gid != -1 {
+		if err := os.Chown(path, o.uid, o.gid); err != nil {
+			return fmt.Errorf("error changing socket ownership: %w", err)
+		}
+	}
+	if o.hasMode {
+		if err := os.Chmod(path, o.mode); err != nil {
+			return fmt.Errorf("error changing socket mode: %w", err)
+		}
+	}
+	return nil
+}
+
+// removeStaleSocket removes the socket file left over at path by a process
+// which did not shut down cleanly. Sockets still accepting connections and
+// other files are left alone.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("error checking socket %s: %w", path, err)
+	}
+	return os.Remove(path)
+}
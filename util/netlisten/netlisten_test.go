@@ -0,0 +1,114 @@
+package netlisten
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSocketOptions(t *testing.T) {
+	testCases := []struct {
+		query    string
+		expected socketOptions
+		err      bool
+	}{
+		{
+			query:    "",
+			expected: socketOptions{uid: -1, gid: -1},
+		},
+		{
+			query:    "mode=0660",
+			expected: socketOptions{mode: 0o660, hasMode: true, uid: -1, gid: -1},
+		},
+		{
+			query:    "mode=600&owner=1000&group=1001",
+			expected: socketOptions{mode: 0o600, hasMode: true, uid: 1000, gid: 1001},
+		},
+		{
+			query:    "owner=root",
+			expected: socketOptions{uid: 0, gid: -1},
+		},
+		{query: "mode=0999", err: true},
+		{query: "owner=no-such-user-demoapp", err: true},
+		{query: "group=no-such-group-demoapp", err: true},
+		{query: "perm=0660", err: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			opts, err := parseSocketOptions(tc.query)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, opts)
+		})
+	}
+}
+
+func TestListenUnixMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demoapp.sock")
+	l, err := Listen(UnixPrefix + path + "?mode=0600")
+	require.NoError(t, err)
+	defer l.Close()
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	require.NotZero(t, fi.Mode()&os.ModeSocket)
+
+	_, err = Listen(UnixPrefix + path + "?mode=0600")
+	require.ErrorContains(t, err, "in use")
+	_, err = Listen(UnixPrefix + "?mode=0600")
+	require.Error(t, err)
+	_, err = Listen(UnixPrefix + "@demoapp?mode=0600")
+	require.Error(t, err)
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// Missing files are ignored.
+	require.NoError(t, removeStaleSocket(filepath.Join(dir, "missing.sock")))
+
+	// Other files are kept.
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o644))
+	require.ErrorContains(t, removeStaleSocket(file), "not a socket")
+	require.FileExists(t, file)
+
+	// Sockets accepting connections are kept.
+	path := filepath.Join(dir, "demoapp.sock")
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	require.ErrorContains(t, removeStaleSocket(path), "in use")
+
+	// Sockets left over by a closed listener are removed.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, l.Close())
+	require.FileExists(t, path)
+	require.NoError(t, removeStaleSocket(path))
+	require.NoFileExists(t, path)
+}
+
+func TestListenUnixOwnerKeepsUmaskMode(t *testing.T) {
+	umask := syscall.Umask(0o022)
+	defer syscall.Umask(umask)
+
+	path := filepath.Join(t.TempDir(), "demoapp.sock")
+	l, err := Listen(UnixPrefix + path + "?owner=" + strconv.Itoa(os.Getuid()))
+	require.NoError(t, err)
+	defer l.Close()
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), fi.Mode().Perm())
+	// The umask of the process is unchanged.
+	require.Equal(t, 0o022, syscall.Umask(0o022))
+}
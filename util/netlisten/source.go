@@ -0,0 +1,375 @@
+package netlisten
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+const (
+	// envListenFDs holds the JSON encoded keys of the sockets passed by the
+	// parent process, starting at file descriptor 3.
+	envListenFDs = "DEMOAPP_LISTEN_FDS"
+	// envReadyFD holds the file descriptor the child process writes to once
+	// it is ready to take over.
+	envReadyFD = "DEMOAPP_READY_FD"
+
+	systemdKeyPrefix = "systemd:"
+	packetKeyPrefix  = "udp:"
+	firstInheritedFD = 3
+)
+
+type socket struct {
+	key string
+	l   net.Listener
+	pc  net.PacketConn
+}
+
+// Source opens the sockets of the demoapp servers. It reuses the sockets
+// inherited from systemd socket activation or from a parent process, and can
+// hand all its sockets over to a new process.
+type Source struct {
+	systemd bool
+
+	mtx       sync.Mutex
+	inherited map[string]*socket
+	opened    []*socket
+	readyFile *os.File
+}
+
+// NewSource returns a Source picking up the sockets inherited from a parent
+// process. If systemd is true, the systemd socket activation listeners are
+// used instead of the web listen addresses.
+func NewSource(systemd bool) (*Source, error) {
+	s := &Source{
+		systemd:   systemd,
+		inherited: map[string]*socket{},
+	}
+
+	if v := os.Getenv(envListenFDs); v != "" {
+		keys, readyFD, err := parseInheritedFDs(v, os.Getenv(envReadyFD))
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range keys {
+			sock, err := inheritSocket(key, os.NewFile(uintptr(firstInheritedFD+i), key))
+			if err != nil {
+				return nil, err
+			}
+			s.inherited[key] = sock
+		}
+		if readyFD >= 0 {
+			s.readyFile = os.NewFile(uintptr(readyFD), "ready")
+		}
+		os.Unsetenv(envListenFDs)
+		os.Unsetenv(envReadyFD)
+		return s, nil
+	}
+
+	if systemd {
+		listeners, err := activation.Listeners()
+		if err != nil {
+			return nil, err
+		}
+		for i, l := range listeners {
+			if l == nil {
+				continue
+			}
+			key := systemdKeyPrefix + strconv.Itoa(i)
+			s.inherited[key] = &socket{key: key, l: l}
+		}
+	}
+	return s, nil
+}
+
+// parseInheritedFDs parses the environment set by the parent process: the
+// keys of the sockets passed from the first inherited file descriptor on, and
+// the file descriptor of the ready pipe, -1 if unset.
+func parseInheritedFDs(listenFDs, readyFD string) ([]string, int, error) {
+	var keys []string
+	if err := json.Unmarshal([]byte(listenFDs), &keys); err != nil {
+		return nil, 0, fmt.Errorf("invalid %s: %w", envListenFDs, err)
+	}
+	if readyFD == "" {
+		return keys, -1, nil
+	}
+	fd, err := strconv.Atoi(readyFD)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid %s: %w", envReadyFD, err)
+	}
+	if fd < firstInheritedFD+len(keys) {
+		return nil, 0, fmt.Errorf("invalid %s: %d overlaps the inherited sockets", envReadyFD, fd)
+	}
+	return keys, fd, nil
+}
+
+// inheritSocket returns the socket of the file inherited for key, and closes
+// the file.
+func inheritSocket(key string, f *os.File) (*socket, error) {
+	defer f.Close()
+
+	sock := &socket{key: key}
+	var err error
+	if isPacketKey(key) {
+		sock.pc, err = net.FilePacketConn(f)
+	} else {
+		sock.l, err = net.FileListener(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error inheriting socket %q: %w", key, err)
+	}
+	return sock, nil
+}
+
+func isPacketKey(key string) bool {
+	return strings.HasPrefix(key, packetKeyPrefix)
+}
+
+// SystemdEnabled returns whether systemd socket activation is used.
+func (s *Source) SystemdEnabled() bool {
+	return s.systemd
+}
+
+// Listen returns the inherited listener for address, or announces on it.
+func (s *Source) Listen(address string) (net.Listener, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if sock, ok := s.inherited[address]; ok && sock.l != nil {
+		delete(s.inherited, address)
+		s.opened = append(s.opened, sock)
+		return sock.l, nil
+	}
+	l, err := Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	s.opened = append(s.opened, &socket{key: address, l: l})
+	return l, nil
+}
+
+// ListenPacket returns the inherited UDP socket for address, or announces on it.
+func (s *Source) ListenPacket(address string) (net.PacketConn, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	key := packetKeyPrefix + address
+	if sock, ok := s.inherited[key]; ok {
+		delete(s.inherited, key)
+		s.opened = append(s.opened, sock)
+		return sock.pc, nil
+	}
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	s.opened = append(s.opened, &socket{key: key, pc: pc})
+	return pc, nil
+}
+
+// Systemd returns the listeners activated by systemd, in file descriptor order.
+func (s *Source) Systemd() ([]net.Listener, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var keys []string
+	for key := range s.inherited {
+		if strings.HasPrefix(key, systemdKeyPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no socket activation file descriptors found")
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimPrefix(keys[i], systemdKeyPrefix))
+		b, _ := strconv.Atoi(strings.TrimPrefix(keys[j], systemdKeyPrefix))
+		return a < b
+	})
+
+	listeners := make([]net.Listener, 0, len(keys))
+	for _, key := range keys {
+		sock := s.inherited[key]
+		delete(s.inherited, key)
+		s.opened = append(s.opened, sock)
+		listeners = append(listeners, sock.l)
+	}
+	return listeners, nil
+}
+
+// CloseUnused closes the inherited sockets which are not used anymore, for
+// instance because the listen addresses changed between both processes.
+func (s *Source) CloseUnused() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for key, sock := range s.inherited {
+		if sock.l != nil {
+			sock.l.Close()
+		}
+		if sock.pc != nil {
+			sock.pc.Close()
+		}
+		delete(s.inherited, key)
+	}
+}
+
+// NotifyReady tells the parent process that this process took over, it is a
+// no-op if the sockets were not inherited from a parent process.
+func (s *Source) NotifyReady() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.readyFile == nil {
+		return nil
+	}
+	_, err := s.readyFile.Write([]byte{1})
+	s.readyFile.Close()
+	s.readyFile = nil
+	return err
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// files returns duplicates of the file descriptors of the opened sockets.
+func (s *Source) files() ([]*os.File, []string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	files := make([]*os.File, 0, len(s.opened))
+	keys := make([]string, 0, len(s.opened))
+	for _, sock := range s.opened {
+		var c interface{} = sock.l
+		if sock.pc != nil {
+			c = sock.pc
+		}
+		f, ok := c.(filer)
+		if !ok {
+			closeFiles(files)
+			return nil, nil, fmt.Errorf("socket %q cannot be handed over", sock.key)
+		}
+		file, err := f.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, err
+		}
+		files = append(files, file)
+		keys = append(keys, sock.key)
+	}
+	return files, keys, nil
+}
+
+// keepSocketFiles keeps the files of the Unix domain sockets when their
+// listeners are closed, once a new process serves on them.
+func (s *Source) keepSocketFiles() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, sock := range s.opened {
+		if ul, ok := sock.l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// Upgrade starts the current executable with the same arguments and hands it
+// all the opened sockets. It returns once the new process is ready to serve,
+// or with an error if it exited or did not become ready before the timeout.
+// Under systemd, the new process is announced as the main process of the
+// service, which requires NotifyAccess=all in the service unit.
+func (s *Source) Upgrade(timeout time.Duration) (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	files, keys, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	defer closeFiles(files)
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+
+	encodedKeys, err := json.Marshal(keys)
+	if err != nil {
+		readyW.Close()
+		return nil, err
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		envListenFDs+"="+string(encodedKeys),
+		envReadyFD+"="+strconv.Itoa(firstInheritedFD+len(files)),
+	)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Do not leave a zombie behind if the new process fails.
+	go cmd.Wait()
+
+	if err := waitReady(readyR, timeout); err != nil {
+		cmd.Process.Signal(syscall.SIGTERM)
+		return nil, err
+	}
+	// Under systemd, the new process must become the main process of the
+	// service before this one exits or it is killed along with the service.
+	if _, err := daemon.SdNotify(false, fmt.Sprintf("MAINPID=%d", cmd.Process.Pid)); err != nil {
+		cmd.Process.Signal(syscall.SIGTERM)
+		return nil, fmt.Errorf("error notifying systemd of the new main process: %w", err)
+	}
+	s.keepSocketFiles()
+	return cmd.Process, nil
+}
+
+// waitReady waits for the new process to write to the ready pipe.
+func waitReady(r io.Reader, timeout time.Duration) error {
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := r.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			return fmt.Errorf("new process exited before being ready: %w", err)
+		}
+		return nil
+	case <-time.After(timeout):
+		return errors.New("timed out waiting for the new process to be ready")
+	}
+}
@@ -0,0 +1,105 @@
+package netlisten
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInheritedFDs(t *testing.T) {
+	keys, readyFD, err := parseInheritedFDs(`[":8080","udp::9090"]`, "5")
+	require.NoError(t, err)
+	require.Equal(t, []string{":8080", "udp::9090"}, keys)
+	require.Equal(t, 5, readyFD)
+
+	_, readyFD, err = parseInheritedFDs(`[":8080"]`, "")
+	require.NoError(t, err)
+	require.Equal(t, -1, readyFD)
+
+	for _, tc := range []struct{ listenFDs, readyFD string }{
+		{`:8080`, ""},
+		{`[":8080"]`, "ready"},
+		{`[":8080"]`, "3"},
+	} {
+		_, _, err := parseInheritedFDs(tc.listenFDs, tc.readyFD)
+		require.Error(t, err, "%s=%s %s=%s", envListenFDs, tc.listenFDs, envReadyFD, tc.readyFD)
+	}
+}
+
+func TestInheritSocket(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	sock, err := inheritSocket(l.Addr().String(), f)
+	require.NoError(t, err)
+	defer sock.l.Close()
+	require.Equal(t, l.Addr().String(), sock.l.Addr().String())
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	f, err = pc.(*net.UDPConn).File()
+	require.NoError(t, err)
+	sock, err = inheritSocket(packetKeyPrefix+pc.LocalAddr().String(), f)
+	require.NoError(t, err)
+	defer sock.pc.Close()
+	require.Equal(t, pc.LocalAddr().String(), sock.pc.LocalAddr().String())
+
+	// A datagram socket can't be inherited as a listener.
+	f, err = pc.(*net.UDPConn).File()
+	require.NoError(t, err)
+	_, err = inheritSocket(pc.LocalAddr().String(), f)
+	require.Error(t, err)
+}
+
+func TestReadyHandshake(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+
+	child := &Source{readyFile: w}
+	require.NoError(t, child.NotifyReady())
+	require.NoError(t, waitReady(r, 5*time.Second))
+	// Notifying twice is a no-op.
+	require.NoError(t, child.NotifyReady())
+
+	// The parent is told if the child exits without being ready.
+	r, w, err = os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	w.Close()
+	require.ErrorContains(t, waitReady(r, 5*time.Second), "exited")
+
+	r, w, err = os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+	require.ErrorContains(t, waitReady(r, 10*time.Millisecond), "timed out")
+}
+
+func TestKeepSocketFiles(t *testing.T) {
+	s, err := NewSource(false)
+	require.NoError(t, err)
+
+	// The socket files are removed unless a new process took over.
+	path := filepath.Join(t.TempDir(), "demoapp.sock")
+	l, err := s.Listen(UnixPrefix + path)
+	require.NoError(t, err)
+	files, _, err := s.files()
+	require.NoError(t, err)
+	closeFiles(files)
+	require.NoError(t, l.Close())
+	require.NoFileExists(t, path)
+
+	l, err = s.Listen(UnixPrefix + path)
+	require.NoError(t, err)
+	s.keepSocketFiles()
+	require.NoError(t, l.Close())
+	require.FileExists(t, path)
+}
@@ -0,0 +1,213 @@
+package web
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/ilolicon/demoapp/config"
+	"github.com/ilolicon/demoapp/pkg/chilog"
+)
+
+// withRequestID assigns an ID to every request, reusing the one sent by the
+// client in the X-Request-Id header, and returns it in the response.
+func withRequestID(h http.Handler) http.Handler {
+	return middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(middleware.RequestIDHeader, middleware.GetReqID(r.Context()))
+		h.ServeHTTP(w, r)
+	}))
+}
+
+// withClientIP resolves the address of the client through the trusted
+// proxies and stores it in the request context.
+func (h *Handler) withClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mtx.RLock()
+		resolver := h.clientIPResolver
+		h.mtx.RUnlock()
+
+		next.ServeHTTP(w, r.WithContext(ContextWithClientIP(r.Context(), resolver.ClientIP(r))))
+	})
+}
+
+// withAccessLog logs every request not excluded by the access log
+// configuration. The logging handler is built once per access logger.
+func (h *Handler) withAccessLog(next http.Handler) http.Handler {
+	var logging atomic.Pointer[accessLogHandler]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mtx.RLock()
+		logger, file := h.accessLogger, h.accessLogFile
+		excluded := h.config != nil && h.config.AccessLog.Excluded(r.URL.Path)
+		if logger != nil && !excluded && file != nil {
+			// Keep the file open until the entry is written, even if the
+			// configuration changes meanwhile.
+			file.acquire()
+			defer file.release()
+		}
+		h.mtx.RUnlock()
+
+		if logger == nil || excluded {
+			next.ServeHTTP(w, r)
+			return
+		}
+		l := logging.Load()
+		if l == nil || l.logger != logger {
+			l = &accessLogHandler{logger: logger, Handler: middleware.RequestLogger(logger)(next)}
+			logging.Store(l)
+		}
+		l.ServeHTTP(w, r)
+	})
+}
+
+// accessLogHandler logs the requests served by the embedded handler with
+// logger.
+type accessLogHandler struct {
+	http.Handler
+	logger *chilog.Logger
+}
+
+// backupTimeFormat is the timestamp of the files rotated by lumberjack.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// accessLogFile is an access log file rotated by size and age. It is closed
+// once it is retired and the requests logging to it completed.
+type accessLogFile struct {
+	*lumberjack.Logger
+	config config.AccessLogConfig
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	// opened is when the file was opened by this process. existed is whether
+	// the file already existed then, in which case its age is unknown until
+	// it is rotated.
+	opened  time.Time
+	existed bool
+
+	mtx     sync.Mutex
+	refs    int
+	retired bool
+}
+
+func newAccessLogFile(cfg config.AccessLogConfig, l *slog.Logger) (*accessLogFile, error) {
+	r := cfg.Rotation
+	f := &accessLogFile{
+		Logger: &lumberjack.Logger{
+			Filename:   cfg.File,
+			MaxSize:    r.MaxSizeMB,
+			MaxBackups: r.MaxBackups,
+			// Retention is expressed in days, round it up.
+			MaxAge:   int((time.Duration(r.Retention) + 24*time.Hour - 1) / (24 * time.Hour)),
+			Compress: r.Compress,
+		},
+		config: cfg,
+		done:   make(chan struct{}),
+		opened: time.Now(),
+	}
+	_, err := os.Stat(cfg.File)
+	f.existed = err == nil
+	// Open the file right away to report errors on config reload.
+	if _, err := f.Write(nil); err != nil {
+		return nil, fmt.Errorf("error opening access log file: %w", err)
+	}
+
+	if maxAge := time.Duration(r.MaxAge); maxAge > 0 {
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			wait := time.Until(f.started().Add(maxAge))
+			for {
+				t := time.NewTimer(wait)
+				select {
+				case <-t.C:
+				case <-f.done:
+					t.Stop()
+					return
+				}
+				// The file may have been rotated by size meanwhile.
+				if wait = time.Until(f.started().Add(maxAge)); wait > 0 {
+					continue
+				}
+				if err := f.Rotate(); err != nil {
+					l.Error("Error rotating access log file", "file", cfg.File, "err", err)
+				}
+				wait = maxAge
+			}
+		}()
+	}
+	return f, nil
+}
+
+// started returns when the current file was started, which is the time of the
+// last rotation. The file is assumed to be started when it was opened if it
+// was never rotated or if it was created then.
+func (f *accessLogFile) started() time.Time {
+	var last time.Time
+	dir, name := filepath.Split(f.Filename)
+	ext := filepath.Ext(name)
+	prefix := strings.TrimSuffix(name, ext) + "-"
+	entries, _ := os.ReadDir(filepath.Clean(dir))
+	for _, e := range entries {
+		backup := strings.TrimSuffix(e.Name(), ".gz")
+		if !strings.HasPrefix(backup, prefix) || !strings.HasSuffix(backup, ext) || len(backup) < len(prefix)+len(ext) {
+			continue
+		}
+		t, err := time.Parse(backupTimeFormat, backup[len(prefix):len(backup)-len(ext)])
+		if err == nil && t.After(last) {
+			last = t
+		}
+	}
+	if last.IsZero() || (!f.existed && f.opened.After(last)) {
+		return f.opened
+	}
+	return last
+}
+
+// reusable returns whether the file can be kept for the given configuration.
+func (f *accessLogFile) reusable(cfg config.AccessLogConfig) bool {
+	return f.config.File == cfg.File && f.config.Rotation == cfg.Rotation
+}
+
+// acquire marks the file as used by a request.
+func (f *accessLogFile) acquire() {
+	f.mtx.Lock()
+	f.refs++
+	f.mtx.Unlock()
+}
+
+// release marks the request as completed, closing the file if it is the last
+// one of a retired file.
+func (f *accessLogFile) release() {
+	f.mtx.Lock()
+	f.refs--
+	last := f.retired && f.refs == 0
+	f.mtx.Unlock()
+	if last {
+		f.Close()
+	}
+}
+
+// retire closes the file once the requests logging to it completed.
+func (f *accessLogFile) retire() {
+	f.mtx.Lock()
+	f.retired = true
+	last := f.refs == 0
+	f.mtx.Unlock()
+	if last {
+		f.Close()
+	}
+}
+
+func (f *accessLogFile) Close() error {
+	close(f.done)
+	f.wg.Wait()
+	return f.Logger.Close()
+}
@@ -0,0 +1,155 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/ilolicon/demoapp/config"
+)
+
+func newTestHandler(t *testing.T, cfg string) *Handler {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	h := New(nil, &Options{
+		Version:    &DemoappVersion{},
+		Gatherer:   reg,
+		Registerer: reg,
+	})
+	conf, err := config.Load(cfg)
+	require.NoError(t, err)
+	require.NoError(t, h.ApplyConfig(conf))
+	t.Cleanup(func() {
+		if h.accessLogFile != nil {
+			h.accessLogFile.retire()
+		}
+	})
+	return h
+}
+
+func TestAccessLogRequestID(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "access.log")
+	h := newTestHandler(t, "access_log: {format: json, file: "+file+", exclude_paths: [/-/*]}")
+	handler := withRequestID(h.withClientIP(h.withAccessLog(http.HandlerFunc(h.echo))))
+
+	// The request ID of the client is kept.
+	req := httptest.NewRequest(http.MethodGet, "/echo", nil)
+	req.Header.Set(middleware.RequestIDHeader, "abc")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, "abc", rec.Header().Get(middleware.RequestIDHeader))
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/echo", nil))
+	generated := rec.Header().Get(middleware.RequestIDHeader)
+	require.NotEmpty(t, generated)
+
+	// Excluded paths aren't logged.
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/-/healthy", nil))
+
+	b, err := os.ReadFile(file)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 2)
+	for i, id := range []string{"abc", generated} {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(lines[i]), &entry))
+		require.Equal(t, id, entry["req_id"])
+		require.Equal(t, "192.0.2.1", entry["client_ip"])
+	}
+}
+
+func TestAccessLogFileRetiredAfterRequests(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.log"), filepath.Join(dir, "second.log")
+	h := newTestHandler(t, "access_log: {format: combined, file: "+first+"}")
+	file := h.accessLogFile
+
+	started, unblock := make(chan struct{}), make(chan struct{})
+	handler := h.withAccessLog(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		close(started)
+		<-unblock
+	}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+	}()
+	<-started
+
+	conf, err := config.Load("access_log: {format: combined, file: " + second + "}")
+	require.NoError(t, err)
+	require.NoError(t, h.ApplyConfig(conf))
+
+	// The file stays open until the in-flight request is logged.
+	select {
+	case <-file.done:
+		t.Fatal("access log file closed with a request in flight")
+	default:
+	}
+	close(unblock)
+	<-done
+	select {
+	case <-file.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("access log file not closed after the request completed")
+	}
+
+	b, err := os.ReadFile(first)
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"GET /slow HTTP/1.1" 200`)
+}
+
+func TestAccessLogFileInvalidConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "access.log")
+	h := newTestHandler(t, "")
+
+	conf := config.DefaultConfig
+	conf.AccessLog.File = file
+	conf.AccessLog.Format = "xml"
+	require.Error(t, h.ApplyConfig(&conf))
+	require.Nil(t, h.accessLogFile)
+}
+
+func TestAccessLogFileStarted(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "access.log")
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	f := &accessLogFile{opened: now}
+	f.Logger = &lumberjack.Logger{Filename: name}
+
+	// Without rotated files, the file is as old as the process opened it.
+	require.Equal(t, now, f.started())
+
+	for _, backup := range []string{
+		"access-" + now.Add(-2*time.Hour).Format(backupTimeFormat) + ".log.gz",
+		"access-" + now.Add(-time.Hour).Format(backupTimeFormat) + ".log",
+		"access-invalid.log",
+		"other-" + now.Add(-time.Minute).Format(backupTimeFormat) + ".log",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, backup), nil, 0o644))
+	}
+
+	// An existing file was started by the last rotation.
+	f.existed = true
+	require.Equal(t, now.Add(-time.Hour), f.started())
+
+	// A file created at opening is newer than the rotated files.
+	f.existed = false
+	require.Equal(t, now, f.started())
+
+	// The file rotated by size since it was opened is started then.
+	rotated := now.Add(time.Minute)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "access-"+rotated.Format(backupTimeFormat)+".log"), nil, 0o644))
+	require.Equal(t, rotated, f.started())
+}
@@ -1,8 +1,11 @@
 package v1
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"strconv"
@@ -15,6 +18,9 @@ import (
 
 type status string
 
+// maxConfigSize limits the size of the configuration files sent to the API.
+const maxConfigSize = 1 << 20
+
 const (
 	statusSuccess status = "success"
 	statusError   status = "error"
@@ -36,6 +42,7 @@ const (
 	errorUnavailable   errorType = "unavailable"
 	errorNotFound      errorType = "not_found"
 	errorNotAcceptable errorType = "not_acceptable"
+	errorForbidden     errorType = "forbidden"
 )
 
 type apiError struct {
@@ -64,6 +71,20 @@ type RuntimeInfo struct {
 	GoMAXPROCS     int    `json:"GOMAXPROCS"`
 }
 
+// LogLevels gets and sets the logging levels at runtime.
+type LogLevels interface {
+	Level() string
+	SetLevel(level string) error
+	ComponentLevels() map[string]string
+	SetComponentLevel(component, level string) error
+}
+
+// LogLevelStatus contains the current logging levels of Demoapp.
+type LogLevelStatus struct {
+	Level      string            `json:"level"`
+	Components map[string]string `json:"components"`
+}
+
 // Response contains a response to a HTTP API request.
 type Response struct {
 	Status    status      `json:"status"`
@@ -118,9 +139,14 @@ type API struct {
 	flagsMap map[string]string
 	ready    func(http.HandlerFunc) http.HandlerFunc
 
-	buildInfo   *DemoappVersion
-	runtimeInfo func() (RuntimeInfo, error)
-	gatherer    prometheus.Gatherer
+	buildInfo    *DemoappVersion
+	runtimeInfo  func() (RuntimeInfo, error)
+	updateConfig func(ctx context.Context, content []byte) error
+	gatherer     prometheus.Gatherer
+	logLevels    LogLevels
+
+	enableLifecycle bool
+	enableConfigAPI bool
 }
 
 func NewAPI(
@@ -130,20 +156,30 @@ func NewAPI(
 	ready func(http.HandlerFunc) http.HandlerFunc,
 	runtimeInfo func() (RuntimeInfo, error),
 	buildInfo *DemoappVersion,
+	updateConfig func(ctx context.Context, content []byte) error,
 	gatherer prometheus.Gatherer,
+	logLevels LogLevels,
+	enableLifecycle bool,
+	enableConfigAPI bool,
 ) *API {
 	return &API{
-		logger:      logger,
-		config:      config,
-		flagsMap:    flagsMap,
-		ready:       ready,
-		runtimeInfo: runtimeInfo,
-		buildInfo:   buildInfo,
-		gatherer:    gatherer,
+		logger:       logger,
+		config:       config,
+		flagsMap:     flagsMap,
+		ready:        ready,
+		runtimeInfo:  runtimeInfo,
+		buildInfo:    buildInfo,
+		updateConfig: updateConfig,
+		gatherer:     gatherer,
+		logLevels:    logLevels,
+
+		enableLifecycle: enableLifecycle,
+		enableConfigAPI: enableConfigAPI,
 	}
 }
 
-// Register the API's endpoints in the given router.:w
+// Register the API's endpoints in the given router. The routes are described
+// in openapi.json, keep them in sync.
 func (api *API) Register(r *route.Router) {
 	wrap := func(f apiFunc) http.HandlerFunc {
 		hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -152,7 +188,7 @@ func (api *API) Register(r *route.Router) {
 				defer result.finalizer()
 			}
 			if result.err != nil {
-				api.respondError(w, result.err, result.data)
+				api.respondError(w, r, result.err, result.data)
 				return
 			}
 			if result.data != nil {
@@ -165,78 +201,149 @@ func (api *API) Register(r *route.Router) {
 	}
 
 	r.Get("/status/config", wrap(api.serveConfig))
+	r.Put("/status/config", wrap(api.configAPI(api.replaceConfig)))
 	r.Get("/status/runtimeinfo", wrap(api.serveRuntimeInfo))
 	r.Get("/status/buildinfo", wrap(api.serveBuildInfo))
 	r.Get("/status/flags", wrap(api.serveFlags))
 	r.Get("/status/date", wrap(api.serveDate))
 	r.Get("/status/code/:code", wrap(api.serveStatusCode))
+	r.Get("/status/metrics", wrap(api.serveMetrics))
+	r.Get("/status/loglevel", wrap(api.logLevelsAPI(api.serveLogLevel)))
+	r.Put("/status/loglevel", wrap(api.lifecycle(api.logLevelsAPI(api.updateLogLevel))))
+
+	r.Get("/openapi.json", api.serveOpenAPI)
+	r.Get("/docs", api.serveDocs)
 }
 
-func (api *API) respond(w http.ResponseWriter, req *http.Request, data interface{}, code int) {
-	statusMessage := statusSuccess
+// lifecycle rejects the requests to f if the lifecycle API is not enabled.
+func (api *API) lifecycle(f apiFunc) apiFunc {
+	return func(r *http.Request) apiFuncResult {
+		if !api.enableLifecycle {
+			return *newAPIFuncResult(nil, WithErr(&apiError{errorForbidden, errors.New("lifecycle API is not enabled")}))
+		}
+		return f(r)
+	}
+}
 
-	resp := &Response{
-		Status: statusMessage,
-		Data:   data,
+// configAPI rejects the requests to f if the configuration API is not
+// enabled.
+func (api *API) configAPI(f apiFunc) apiFunc {
+	return func(r *http.Request) apiFuncResult {
+		if !api.enableConfigAPI {
+			return *newAPIFuncResult(nil, WithErr(&apiError{errorForbidden, errors.New("configuration API is not enabled")}))
+		}
+		return f(r)
 	}
-	b, err := json.Marshal(resp)
-	if err != nil {
-		api.logger.Error("error marshaling response", "url", req.URL, "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+}
+
+// logLevelsAPI rejects the requests to f if the logging levels can't be
+// changed at runtime.
+func (api *API) logLevelsAPI(f apiFunc) apiFunc {
+	return func(r *http.Request) apiFuncResult {
+		if api.logLevels == nil {
+			return *newAPIFuncResult(nil, WithErr(&apiError{errorUnavailable, errors.New("runtime log levels are not available")}))
+		}
+		return f(r)
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	if n, err := w.Write(b); err != nil {
-		api.logger.Error("error writing response", "url", req.URL, "bytesWritten", n, "err", err)
+func (api *API) respond(w http.ResponseWriter, req *http.Request, data interface{}, code int) {
+	resp := &Response{
+		Status: statusSuccess,
+		Data:   data,
+	}
+	if err := writeResponse(w, req, resp, code); err != nil {
+		api.logger.ErrorContext(req.Context(), "error writing response", "url", req.URL, "err", err)
 	}
 }
 
-func (api *API) respondError(w http.ResponseWriter, apiErr *apiError, data interface{}) {
-	b, err := json.Marshal(&Response{
+func (api *API) respondError(w http.ResponseWriter, req *http.Request, apiErr *apiError, data interface{}) {
+	resp := &Response{
 		Status:    statusError,
 		ErrorType: apiErr.typ,
 		Error:     apiErr.err.Error(),
 		Data:      data,
-	})
-	if err != nil {
-		api.logger.Error("error marshaling json response", "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
 	}
+	if err := writeResponse(w, req, resp, apiErr.code()); err != nil {
+		api.logger.ErrorContext(req.Context(), "error writing response", "url", req.URL, "err", err)
+	}
+}
 
-	var code int
-	switch apiErr.typ {
+// code returns the HTTP status code of the error type.
+func (e *apiError) code() int {
+	switch e.typ {
 	case errorBadData:
-		code = http.StatusBadRequest
+		return http.StatusBadRequest
 	case errorExec:
-		code = http.StatusUnprocessableEntity
+		return http.StatusUnprocessableEntity
 	case errorCanceled:
-		code = statusClientClosedConnection
+		return statusClientClosedConnection
 	case errorTimeout:
-		code = http.StatusServiceUnavailable
+		return http.StatusServiceUnavailable
 	case errorInternal:
-		code = http.StatusInternalServerError
+		return http.StatusInternalServerError
+	case errorUnavailable:
+		return http.StatusServiceUnavailable
 	case errorNotFound:
-		code = http.StatusNotFound
+		return http.StatusNotFound
 	case errorNotAcceptable:
-		code = http.StatusNotAcceptable
+		return http.StatusNotAcceptable
+	case errorForbidden:
+		return http.StatusForbidden
 	default:
-		code = http.StatusInternalServerError
+		return http.StatusInternalServerError
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	if n, err := w.Write(b); err != nil {
-		api.logger.Error("error writing response", "bytesWritten", n, "err", err)
+// ErrUnavailable wraps err to be answered with 503 and the unavailable error
+// type.
+func ErrUnavailable(err error) error {
+	return &apiError{errorUnavailable, err}
+}
+
+// ErrTimeout wraps err to be answered with 503 and the timeout error type.
+func ErrTimeout(err error) error {
+	return &apiError{errorTimeout, err}
+}
+
+// ErrCanceled wraps err to be answered with 499 and the canceled error type.
+func ErrCanceled(err error) error {
+	return &apiError{errorCanceled, err}
+}
+
+// RespondError writes err in the API error format, for the handlers outside
+// of the API. Errors not created by this package are answered as internal
+// errors.
+func RespondError(w http.ResponseWriter, err error) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		apiErr = &apiError{errorInternal, err}
 	}
+	b, _ := json.Marshal(&Response{
+		Status:    statusError,
+		ErrorType: apiErr.typ,
+		Error:     apiErr.err.Error(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.code())
+	w.Write(b)
 }
 
 type demoappConfig struct {
 	YAML string `json:"yaml"`
 }
 
+// Text returns the configuration file, for the plain text responses.
+func (c *demoappConfig) Text() string {
+	return c.YAML
+}
+
+// YAMLDocument returns the configuration file, for the YAML responses.
+func (c *demoappConfig) YAMLDocument() string {
+	return c.YAML
+}
+
 func (api *API) serveRuntimeInfo(_ *http.Request) apiFuncResult {
 	status, err := api.runtimeInfo()
 	if err != nil {
@@ -256,6 +363,27 @@ func (api *API) serveConfig(_ *http.Request) apiFuncResult {
 	return *newAPIFuncResult(cfg)
 }
 
+// replaceConfig replaces the configuration file with the request body and
+// reloads it. The content is validated by updateConfig.
+func (api *API) replaceConfig(r *http.Request) apiFuncResult {
+	content, err := io.ReadAll(io.LimitReader(r.Body, maxConfigSize+1))
+	if err != nil {
+		return *newAPIFuncResult(nil, WithErr(&apiError{errorBadData, err}))
+	}
+	if len(content) > maxConfigSize {
+		return *newAPIFuncResult(nil, WithErr(&apiError{errorBadData, fmt.Errorf("configuration larger than %d bytes", maxConfigSize)}))
+	}
+	if err := api.updateConfig(r.Context(), content); err != nil {
+		if errors.Is(err, config.ErrInvalidConfig) {
+			return *newAPIFuncResult(nil, WithErr(&apiError{errorBadData, err}))
+		}
+		return *newAPIFuncResult(nil, WithErr(&apiError{errorInternal, fmt.Errorf("failed to apply configuration: %w", err)}))
+	}
+
+	api.logger.Info("Replaced configuration file")
+	return api.serveConfig(r)
+}
+
 func (api *API) serveFlags(_ *http.Request) apiFuncResult {
 	return *newAPIFuncResult(api.flagsMap)
 }
@@ -289,3 +417,38 @@ func (api *API) serveStatusCode(r *http.Request) apiFuncResult {
 	}
 	return *newAPIFuncResult(code, WithCode(i))
 }
+
+func (api *API) logLevelStatus() LogLevelStatus {
+	return LogLevelStatus{
+		Level:      api.logLevels.Level(),
+		Components: api.logLevels.ComponentLevels(),
+	}
+}
+
+func (api *API) serveLogLevel(_ *http.Request) apiFuncResult {
+	return *newAPIFuncResult(api.logLevelStatus())
+}
+
+// updateLogLevel sets the root logging level, or the level of a single
+// component if the component parameter is given. An empty level resets the
+// component to the root level.
+func (api *API) updateLogLevel(r *http.Request) apiFuncResult {
+	level := r.FormValue("level")
+	component := r.FormValue("component")
+
+	var err error
+	switch {
+	case component != "":
+		err = api.logLevels.SetComponentLevel(component, level)
+	case level == "":
+		err = errors.New("level parameter is required")
+	default:
+		err = api.logLevels.SetLevel(level)
+	}
+	if err != nil {
+		return *newAPIFuncResult(nil, WithErr(&apiError{errorBadData, err}))
+	}
+
+	api.logger.Info("Changed log level", "level", level, "component", component)
+	return *newAPIFuncResult(api.logLevelStatus())
+}
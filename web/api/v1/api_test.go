@@ -0,0 +1,158 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/common/route"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ilolicon/demoapp/config"
+	"github.com/ilolicon/demoapp/util/loglevel"
+)
+
+// newTestRouter returns a router serving an API with the default
+// configuration. The configuration API is enabled if updateConfig isn't nil.
+func newTestRouter(t *testing.T, logLevels LogLevels, enableLifecycle bool, updateConfig func(context.Context, []byte) error) *route.Router {
+	t.Helper()
+	api := NewAPI(
+		promslog.NewNopLogger(),
+		func() config.Config { return config.DefaultConfig },
+		map[string]string{"web.enable-lifecycle": "true"},
+		func(f http.HandlerFunc) http.HandlerFunc { return f },
+		func() (RuntimeInfo, error) { return RuntimeInfo{Hostname: "test"}, nil },
+		&DemoappVersion{Version: "1.0.0"},
+		updateConfig,
+		prometheus.NewRegistry(),
+		logLevels,
+		enableLifecycle,
+		updateConfig != nil,
+	)
+	r := route.New()
+	api.Register(r)
+	return r
+}
+
+func TestUpdateLogLevel(t *testing.T) {
+	levels, err := loglevel.New("info")
+	require.NoError(t, err)
+	router := newTestRouter(t, levels, true, nil)
+
+	put := func(args url.Values) (int, Response) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPut, "/status/loglevel", strings.NewReader(args.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var resp Response
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return rec.Code, resp
+	}
+
+	code, resp := put(url.Values{"level": {"debug"}})
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, map[string]interface{}{"level": "debug", "components": map[string]interface{}{}}, resp.Data)
+	require.Equal(t, "debug", levels.Level())
+
+	code, resp = put(url.Values{"level": {"warn"}, "component": {"web"}})
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, map[string]interface{}{"level": "debug", "components": map[string]interface{}{"web": "warn"}}, resp.Data)
+
+	for _, args := range []url.Values{
+		{},
+		{"level": {"verbose"}},
+		{"level": {"verbose"}, "component": {"web"}},
+	} {
+		code, resp = put(args)
+		require.Equal(t, http.StatusBadRequest, code, "args %v", args)
+		require.Equal(t, errorBadData, resp.ErrorType)
+	}
+	require.Equal(t, "debug", levels.Level())
+
+	// The levels can't be changed without the lifecycle API.
+	levels, err = loglevel.New("info")
+	require.NoError(t, err)
+	router = newTestRouter(t, levels, false, nil)
+	code, resp = put(url.Values{"level": {"debug"}})
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, errorForbidden, resp.ErrorType)
+	require.Equal(t, "info", levels.Level())
+}
+
+func TestLogLevelsUnavailable(t *testing.T) {
+	router := newTestRouter(t, nil, true, nil)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/status/loglevel", nil),
+		httptest.NewRequest(http.MethodPut, "/status/loglevel?level=debug", nil),
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusServiceUnavailable, rec.Code, req.Method)
+		var resp Response
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		require.Equal(t, errorUnavailable, resp.ErrorType)
+	}
+}
+
+func TestReplaceConfig(t *testing.T) {
+	levels, err := loglevel.New("info")
+	require.NoError(t, err)
+
+	put := func(router *route.Router, content string) (int, Response) {
+		req := httptest.NewRequest(http.MethodPut, "/status/config", strings.NewReader(content))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var resp Response
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return rec.Code, resp
+	}
+
+	// The configuration API is disabled by default, even with the lifecycle
+	// API.
+	code, resp := put(newTestRouter(t, levels, true, nil), "date_format: x\n")
+	require.Equal(t, http.StatusForbidden, code)
+	require.Equal(t, errorForbidden, resp.ErrorType)
+
+	for _, tc := range []struct {
+		name      string
+		err       error
+		code      int
+		errorType errorType
+	}{
+		{name: "success", code: http.StatusOK},
+		{
+			name:      "invalid configuration",
+			err:       fmt.Errorf("%w: yaml: unmarshal errors", config.ErrInvalidConfig),
+			code:      http.StatusBadRequest,
+			errorType: errorBadData,
+		},
+		{
+			name:      "apply failed",
+			err:       errors.New("failed to open access log"),
+			code:      http.StatusInternalServerError,
+			errorType: errorInternal,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var received string
+			router := newTestRouter(t, levels, false, func(_ context.Context, content []byte) error {
+				received = string(content)
+				return tc.err
+			})
+			code, resp := put(router, "date_format: x\n")
+			require.Equal(t, tc.code, code)
+			require.Equal(t, tc.errorType, resp.ErrorType)
+			require.Equal(t, "date_format: x\n", received)
+		})
+	}
+}
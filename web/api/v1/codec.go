@@ -0,0 +1,213 @@
+package v1
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/munnerz/goautoneg"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	contentTypeJSON  = "application/json"
+	contentTypeYAML  = "application/yaml"
+	contentTypeXYAML = "application/x-yaml"
+	contentTypeTYAML = "text/yaml"
+	contentTypeText  = "text/plain"
+)
+
+// offers are the content types of the responses, in order of preference.
+var offers = []string{contentTypeJSON, contentTypeYAML, contentTypeXYAML, contentTypeTYAML, contentTypeText}
+
+var errNotAcceptable = fmt.Errorf("no acceptable content type, supported: %s", strings.Join(offers, ", "))
+
+// codec encodes a Response in a content type.
+type codec struct {
+	contentType string
+	encode      func(resp *Response) ([]byte, error)
+}
+
+// negotiate returns the codec for the Accept header of r. JSON is used when
+// the header is missing, and pretty printed with the pretty query parameter.
+// It returns false if none of the content types are acceptable.
+func negotiate(r *http.Request) (codec, bool) {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		accept = "*/*"
+	}
+	switch contentType := goautoneg.Negotiate(accept, offers); contentType {
+	case contentTypeJSON:
+		if _, ok := r.URL.Query()["pretty"]; ok {
+			return codec{contentTypeJSON, encodePrettyJSON}, true
+		}
+		return codec{contentTypeJSON, encodeJSON}, true
+	case contentTypeYAML, contentTypeXYAML, contentTypeTYAML:
+		return codec{contentType, encodeYAML}, true
+	case contentTypeText:
+		return codec{contentTypeText + "; charset=utf-8", encodeText}, true
+	}
+	return codec{contentTypeJSON, encodeJSON}, false
+}
+
+func encodeJSON(resp *Response) ([]byte, error) {
+	return json.Marshal(resp)
+}
+
+func encodePrettyJSON(resp *Response) ([]byte, error) {
+	b, err := json.MarshalIndent(resp, "", "  ")
+	return append(b, '\n'), err
+}
+
+// generic converts resp into maps, slices and scalars following the JSON
+// field names.
+func generic(resp *Response) (interface{}, error) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err = json.Unmarshal(b, &v)
+	return v, err
+}
+
+// yamler is implemented by the response data which is a YAML document, to be
+// served as is instead of wrapped in the response.
+type yamler interface {
+	YAMLDocument() string
+}
+
+func encodeYAML(resp *Response) ([]byte, error) {
+	if y, ok := resp.Data.(yamler); ok && resp.Status == statusSuccess {
+		return []byte(y.YAMLDocument()), nil
+	}
+	v, err := generic(resp)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(v)
+}
+
+// texter is implemented by the response data having a plain text form.
+type texter interface {
+	Text() string
+}
+
+// encodeText writes the data of the response as a table. Objects are written
+// as key and value rows, lists of objects as one row per element.
+func encodeText(resp *Response) ([]byte, error) {
+	if resp.Status == statusError {
+		if resp.ErrorType == errorNone {
+			return []byte(fmt.Sprintf("error: %s\n", resp.Error)), nil
+		}
+		return []byte(fmt.Sprintf("error (%s): %s\n", resp.ErrorType, resp.Error)), nil
+	}
+	if t, ok := resp.Data.(texter); ok {
+		return []byte(t.Text()), nil
+	}
+	v, err := generic(resp)
+	if err != nil {
+		return nil, err
+	}
+	data := v.(map[string]interface{})["data"]
+
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	switch d := data.(type) {
+	case map[string]interface{}:
+		fmt.Fprintln(tw, "KEY\tVALUE")
+		for _, k := range sortedKeys(d) {
+			fmt.Fprintf(tw, "%s\t%s\n", k, textValue(d[k]))
+		}
+	case []interface{}:
+		writeTextList(tw, d)
+	default:
+		fmt.Fprintln(tw, textValue(d))
+	}
+	if err := tw.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeTextList(tw *tabwriter.Writer, list []interface{}) {
+	columns := map[string]struct{}{}
+	for _, e := range list {
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			// Not a list of objects.
+			for _, e := range list {
+				fmt.Fprintln(tw, textValue(e))
+			}
+			return
+		}
+		for k := range m {
+			columns[k] = struct{}{}
+		}
+	}
+	header := sortedKeys(columns)
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(header, "\t")))
+	for _, e := range list {
+		m := e.(map[string]interface{})
+		row := make([]string, 0, len(header))
+		for _, k := range header {
+			row = append(row, textValue(m[k]))
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+}
+
+// textValue formats a table cell, nested values are written as JSON.
+func textValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeResponse encodes resp with the codec negotiated for r. Requests
+// accepting none of the supported content types are answered with 406.
+func writeResponse(w http.ResponseWriter, r *http.Request, resp *Response, code int) error {
+	c, ok := negotiate(r)
+	if !ok {
+		resp = &Response{
+			Status:    statusError,
+			ErrorType: errorNotAcceptable,
+			Error:     errNotAcceptable.Error(),
+		}
+		code = http.StatusNotAcceptable
+	}
+	b, err := c.encode(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return fmt.Errorf("error encoding response: %w", err)
+	}
+
+	w.Header().Set("Content-Type", c.contentType)
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(code)
+	if n, err := w.Write(b); err != nil {
+		return fmt.Errorf("error writing response (%d bytes written): %w", n, err)
+	}
+	return nil
+}
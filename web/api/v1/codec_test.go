@@ -0,0 +1,156 @@
+package v1
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteResponse(t *testing.T) {
+	object := map[string]string{"b": "2", "a": "1"}
+	list := []map[string]interface{}{{"name": "x", "value": 1}, {"name": "y", "labels": map[string]string{"k": "v"}}}
+	cfg := &demoappConfig{YAML: "date_format: \"2006\"\n"}
+
+	testCases := []struct {
+		name        string
+		accept      string
+		query       string
+		data        interface{}
+		code        int
+		contentType string
+		body        string
+	}{
+		{
+			name:        "no accept header",
+			data:        object,
+			code:        http.StatusOK,
+			contentType: "application/json",
+			body:        `{"status":"success","data":{"a":"1","b":"2"}}`,
+		},
+		{
+			name:        "wildcard",
+			accept:      "text/html, */*;q=0.1",
+			data:        object,
+			code:        http.StatusOK,
+			contentType: "application/json",
+			body:        `{"status":"success","data":{"a":"1","b":"2"}}`,
+		},
+		{
+			name:        "pretty json",
+			accept:      "application/json",
+			query:       "?pretty",
+			data:        object,
+			code:        http.StatusOK,
+			contentType: "application/json",
+			body:        "{\n  \"status\": \"success\",\n  \"data\": {\n    \"a\": \"1\",\n    \"b\": \"2\"\n  }\n}\n",
+		},
+		{
+			name:        "yaml",
+			accept:      "application/yaml",
+			data:        object,
+			code:        http.StatusOK,
+			contentType: "application/yaml",
+			body:        "data:\n    a: \"1\"\n    b: \"2\"\nstatus: success\n",
+		},
+		{
+			name:        "x-yaml",
+			accept:      "application/x-yaml",
+			data:        object,
+			code:        http.StatusOK,
+			contentType: "application/x-yaml",
+			body:        "data:\n    a: \"1\"\n    b: \"2\"\nstatus: success\n",
+		},
+		{
+			name:        "yaml preferred over json",
+			accept:      "application/json;q=0.5, text/yaml",
+			data:        object,
+			code:        http.StatusOK,
+			contentType: "text/yaml",
+			body:        "data:\n    a: \"1\"\n    b: \"2\"\nstatus: success\n",
+		},
+		{
+			name:        "yaml document",
+			accept:      "application/yaml",
+			data:        cfg,
+			code:        http.StatusOK,
+			contentType: "application/yaml",
+			body:        "date_format: \"2006\"\n",
+		},
+		{
+			name:        "json document",
+			accept:      "application/json",
+			data:        cfg,
+			code:        http.StatusOK,
+			contentType: "application/json",
+			body:        `{"status":"success","data":{"yaml":"date_format: \"2006\"\n"}}`,
+		},
+		{
+			name:        "text object",
+			accept:      "text/plain",
+			data:        object,
+			code:        http.StatusOK,
+			contentType: "text/plain; charset=utf-8",
+			body:        "KEY  VALUE\na    1\nb    2\n",
+		},
+		{
+			name:        "text list",
+			accept:      "text/plain",
+			data:        list,
+			code:        http.StatusOK,
+			contentType: "text/plain; charset=utf-8",
+			body:        "LABELS     NAME  VALUE\n           x     1\n{\"k\":\"v\"}  y     \n",
+		},
+		{
+			name:        "text scalar list",
+			accept:      "text/plain",
+			data:        []string{"a", "b"},
+			code:        http.StatusOK,
+			contentType: "text/plain; charset=utf-8",
+			body:        "a\nb\n",
+		},
+		{
+			name:        "texter",
+			accept:      "text/plain",
+			data:        cfg,
+			code:        http.StatusOK,
+			contentType: "text/plain; charset=utf-8",
+			body:        "date_format: \"2006\"\n",
+		},
+		{
+			name:        "not acceptable",
+			accept:      "image/png",
+			data:        object,
+			code:        http.StatusNotAcceptable,
+			contentType: "application/json",
+			body:        `{"status":"error","errorType":"not_acceptable","error":"no acceptable content type, supported: application/json, application/yaml, application/x-yaml, text/yaml, text/plain"}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/status/test"+tc.query, nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			rec := httptest.NewRecorder()
+			require.NoError(t, writeResponse(rec, req, &Response{Status: statusSuccess, Data: tc.data}, http.StatusOK))
+
+			require.Equal(t, tc.code, rec.Code)
+			require.Equal(t, tc.contentType, rec.Header().Get("Content-Type"))
+			require.Equal(t, "Accept", rec.Header().Get("Vary"))
+			require.Equal(t, tc.body, rec.Body.String())
+		})
+	}
+}
+
+func TestEncodeTextError(t *testing.T) {
+	b, err := encodeText(&Response{Status: statusError, ErrorType: errorBadData, Error: "invalid"})
+	require.NoError(t, err)
+	require.Equal(t, "error (bad_data): invalid\n", string(b))
+
+	// Errors are not replaced by the YAML document of the data.
+	b, err = encodeYAML(&Response{Status: statusError, Data: &demoappConfig{YAML: "a: b\n"}, ErrorType: errorBadData, Error: "invalid"})
+	require.NoError(t, err)
+	require.Contains(t, string(b), "errorType: bad_data")
+}
@@ -0,0 +1,236 @@
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricQuantiles are the percentiles estimated for the histograms.
+var metricQuantiles = []float64{0.5, 0.9, 0.99}
+
+// MetricFamily is a metric family of the gatherer.
+type MetricFamily struct {
+	Name    string   `json:"name"`
+	Help    string   `json:"help"`
+	Type    string   `json:"type"`
+	Metrics []Metric `json:"metrics"`
+}
+
+// Metric is a single series of a metric family. Counters, gauges and untyped
+// metrics have a value, summaries and histograms a count, a sum and their
+// quantiles, which are estimated from the buckets for histograms.
+type Metric struct {
+	Labels    map[string]string      `json:"labels,omitempty"`
+	Value     *SampleValue           `json:"value,omitempty"`
+	Count     *uint64                `json:"count,omitempty"`
+	Sum       *SampleValue           `json:"sum,omitempty"`
+	Quantiles map[string]SampleValue `json:"quantiles,omitempty"`
+}
+
+// SampleValue is a float encoded as a JSON number, or as a string for the
+// values JSON can't represent.
+type SampleValue float64
+
+// MarshalJSON implements json.Marshaler.
+func (v SampleValue) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return json.Marshal(strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	return json.Marshal(f)
+}
+
+func (v SampleValue) String() string {
+	return strconv.FormatFloat(float64(v), 'g', -1, 64)
+}
+
+type metricFamilies []MetricFamily
+
+// Text returns the metrics one series per line, for the plain text responses.
+func (mfs metricFamilies) Text() string {
+	var b strings.Builder
+	for _, mf := range mfs {
+		for _, m := range mf.Metrics {
+			b.WriteString(mf.Name)
+			if len(m.Labels) > 0 {
+				pairs := make([]string, 0, len(m.Labels))
+				for _, k := range sortedKeys(m.Labels) {
+					pairs = append(pairs, fmt.Sprintf("%s=%q", k, m.Labels[k]))
+				}
+				fmt.Fprintf(&b, "{%s}", strings.Join(pairs, ","))
+			}
+			if m.Value != nil {
+				fmt.Fprintf(&b, " %s", m.Value)
+			}
+			if m.Count != nil {
+				fmt.Fprintf(&b, " count=%d", *m.Count)
+			}
+			if m.Sum != nil {
+				fmt.Fprintf(&b, " sum=%s", m.Sum)
+			}
+			for _, q := range sortedKeys(m.Quantiles) {
+				fmt.Fprintf(&b, " q%s=%s", q, m.Quantiles[q])
+			}
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// serveMetrics returns the metric families of the gatherer whose names match
+// any of the match regular expressions, or all of them without match.
+func (api *API) serveMetrics(r *http.Request) apiFuncResult {
+	if err := r.ParseForm(); err != nil {
+		return *newAPIFuncResult(nil, WithErr(&apiError{errorBadData, err}))
+	}
+	var matchers []*regexp.Regexp
+	for _, m := range r.Form["match"] {
+		re, err := regexp.Compile("^(?:" + m + ")$")
+		if err != nil {
+			return *newAPIFuncResult(nil, WithErr(&apiError{errorBadData, fmt.Errorf("invalid match %q: %w", m, err)}))
+		}
+		matchers = append(matchers, re)
+	}
+
+	gathered, err := api.gatherer.Gather()
+	if err != nil {
+		if len(gathered) == 0 {
+			return *newAPIFuncResult(nil, WithErr(&apiError{errorInternal, err}))
+		}
+		api.logger.WarnContext(r.Context(), "Error gathering metrics", "err", err)
+	}
+
+	mfs := metricFamilies{}
+	for _, mf := range gathered {
+		if !matchName(matchers, mf.GetName()) {
+			continue
+		}
+		mfs = append(mfs, newMetricFamily(mf))
+	}
+	return *newAPIFuncResult(mfs)
+}
+
+func matchName(matchers []*regexp.Regexp, name string) bool {
+	if len(matchers) == 0 {
+		return true
+	}
+	for _, re := range matchers {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func newMetricFamily(mf *dto.MetricFamily) MetricFamily {
+	f := MetricFamily{
+		Name:    mf.GetName(),
+		Help:    mf.GetHelp(),
+		Type:    strings.ToLower(mf.GetType().String()),
+		Metrics: make([]Metric, 0, len(mf.GetMetric())),
+	}
+	for _, m := range mf.GetMetric() {
+		metric := Metric{}
+		if len(m.GetLabel()) > 0 {
+			metric.Labels = make(map[string]string, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				metric.Labels[l.GetName()] = l.GetValue()
+			}
+		}
+
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			metric.Value = sampleValue(m.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			metric.Value = sampleValue(m.GetGauge().GetValue())
+		case dto.MetricType_UNTYPED:
+			metric.Value = sampleValue(m.GetUntyped().GetValue())
+		case dto.MetricType_SUMMARY:
+			s := m.GetSummary()
+			count := s.GetSampleCount()
+			metric.Count, metric.Sum = &count, sampleValue(s.GetSampleSum())
+			for _, q := range s.GetQuantile() {
+				if math.IsNaN(q.GetValue()) {
+					continue
+				}
+				if metric.Quantiles == nil {
+					metric.Quantiles = map[string]SampleValue{}
+				}
+				metric.Quantiles[formatQuantile(q.GetQuantile())] = SampleValue(q.GetValue())
+			}
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+			h := m.GetHistogram()
+			count := h.GetSampleCount()
+			metric.Count, metric.Sum = &count, sampleValue(h.GetSampleSum())
+			for _, q := range metricQuantiles {
+				v, err := histogramQuantile(q, h.GetBucket(), count)
+				if err != nil {
+					continue
+				}
+				if metric.Quantiles == nil {
+					metric.Quantiles = map[string]SampleValue{}
+				}
+				metric.Quantiles[formatQuantile(q)] = SampleValue(v)
+			}
+		}
+		f.Metrics = append(f.Metrics, metric)
+	}
+	return f
+}
+
+func sampleValue(f float64) *SampleValue {
+	v := SampleValue(f)
+	return &v
+}
+
+func formatQuantile(q float64) string {
+	return strconv.FormatFloat(q, 'f', -1, 64)
+}
+
+// histogramQuantile estimates the q-quantile of the classic histogram buckets
+// by linear interpolation within the bucket it falls into, as the PromQL
+// histogram_quantile function does. The lowest bucket is assumed to start at
+// zero, and quantiles falling into the implicit +Inf bucket are estimated as
+// the upper bound of the highest finite bucket.
+func histogramQuantile(q float64, buckets []*dto.Bucket, count uint64) (float64, error) {
+	if count == 0 {
+		return 0, errors.New("histogram has no observations")
+	}
+	if len(buckets) == 0 {
+		return 0, errors.New("histogram has no buckets")
+	}
+	buckets = append([]*dto.Bucket(nil), buckets...)
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].GetUpperBound() < buckets[j].GetUpperBound()
+	})
+
+	rank := q * float64(count)
+	var lowerBound float64
+	var lowerCount uint64
+	for i, b := range buckets {
+		upperBound, upperCount := b.GetUpperBound(), b.GetCumulativeCount()
+		if math.IsInf(upperBound, 1) {
+			break
+		}
+		if float64(upperCount) >= rank {
+			if i == 0 && upperBound <= 0 {
+				return upperBound, nil
+			}
+			if upperCount == lowerCount {
+				return lowerBound, nil
+			}
+			return lowerBound + (upperBound-lowerBound)*(rank-float64(lowerCount))/float64(upperCount-lowerCount), nil
+		}
+		lowerBound, lowerCount = upperBound, upperCount
+	}
+	return lowerBound, nil
+}
@@ -0,0 +1,55 @@
+package v1
+
+import (
+	"math"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogramQuantile(t *testing.T) {
+	bucket := func(upperBound float64, count uint64) *dto.Bucket {
+		return &dto.Bucket{UpperBound: &upperBound, CumulativeCount: &count}
+	}
+	buckets := []*dto.Bucket{
+		bucket(0.1, 50),
+		bucket(0.5, 90),
+		bucket(1, 100),
+	}
+
+	for _, tc := range []struct {
+		q        float64
+		count    uint64
+		expected float64
+	}{
+		{q: 0.5, count: 100, expected: 0.1},
+		{q: 0.25, count: 100, expected: 0.05},
+		{q: 0.7, count: 100, expected: 0.3},
+		{q: 0.95, count: 100, expected: 0.75},
+		// Observations above the highest bucket.
+		{q: 0.99, count: 200, expected: 1},
+	} {
+		v, err := histogramQuantile(tc.q, buckets, tc.count)
+		require.NoError(t, err)
+		require.InDelta(t, tc.expected, v, 1e-9, "q=%v", tc.q)
+	}
+
+	_, err := histogramQuantile(0.5, buckets, 0)
+	require.Error(t, err)
+}
+
+func TestSampleValueMarshalJSON(t *testing.T) {
+	for v, expected := range map[float64]string{
+		1.5:          `1.5`,
+		math.Inf(1):  `"+Inf"`,
+		math.Inf(-1): `"-Inf"`,
+	} {
+		b, err := SampleValue(v).MarshalJSON()
+		require.NoError(t, err)
+		require.Equal(t, expected, string(b))
+	}
+	b, err := SampleValue(math.NaN()).MarshalJSON()
+	require.NoError(t, err)
+	require.Equal(t, `"NaN"`, string(b))
+}
@@ -0,0 +1,69 @@
+package web
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/ilolicon/demoapp/config"
+)
+
+// connState tracks a connection to enforce the connection lifetime limits.
+type connState struct {
+	created  time.Time
+	requests atomic.Int64
+	// closing is set once the connection was asked to close, so that it is
+	// only counted once.
+	closing atomic.Bool
+}
+
+type connStateKey struct{}
+
+// connContext stores a new connState in the context of each connection.
+func connContext(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, connStateKey{}, &connState{created: time.Now()})
+}
+
+// closeReason returns why the connection of the current request must be
+// closed after the response, or an empty string if it can be kept alive.
+func (s *connState) closeReason(cfg config.ConnectionsConfig) string {
+	requests := s.requests.Add(1)
+	switch {
+	case cfg.DisableKeepAlives:
+		return "keep_alives_disabled"
+	case cfg.MaxRequests > 0 && requests >= int64(cfg.MaxRequests):
+		return "max_requests"
+	case cfg.MaxAge > 0 && time.Since(s.created) >= time.Duration(cfg.MaxAge):
+		return "max_age"
+	}
+	return ""
+}
+
+// withConnectionLifetime asks clients to close their connection once it
+// exceeds the configured age or number of requests. net/http closes HTTP/1.x
+// connections after a response with a "Connection: close" header and sends a
+// GOAWAY frame on HTTP/2 connections.
+func (h *Handler) withConnectionLifetime(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mtx.RLock()
+		var cfg config.ConnectionsConfig
+		if h.config != nil {
+			cfg = h.config.Connections
+		}
+		h.mtx.RUnlock()
+
+		if s, ok := r.Context().Value(connStateKey{}).(*connState); ok {
+			if reason := s.closeReason(cfg); reason != "" {
+				w.Header().Set("Connection", "close")
+				// HTTP/2 streams keep coming until the client handles the
+				// GOAWAY frame.
+				if s.closing.CompareAndSwap(false, true) {
+					h.metrics.connectionsClosed.WithLabelValues(reason).Inc()
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
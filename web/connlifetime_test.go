@@ -0,0 +1,65 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionLifetimeMaxRequests(t *testing.T) {
+	h := newTestHandler(t, "connections: {max_requests: 2}")
+	srv := httptest.NewUnstartedServer(h.withConnectionLifetime(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "ok")
+	})))
+	srv.Config.ConnContext = connContext
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	get := func() textproto.MIMEHeader {
+		_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		status, err := tp.ReadLine()
+		require.NoError(t, err)
+		require.Equal(t, "HTTP/1.1 200 OK", status)
+		header, err := tp.ReadMIMEHeader()
+		require.NoError(t, err)
+		body := make([]byte, 2)
+		_, err = io.ReadFull(tp.R, body)
+		require.NoError(t, err)
+		return header
+	}
+
+	require.Empty(t, get().Get("Connection"))
+
+	// The connection is closed after max_requests requests.
+	require.Equal(t, "close", get().Get("Connection"))
+	require.Equal(t, 1.0, testutil.ToFloat64(h.metrics.connectionsClosed.WithLabelValues("max_requests")))
+	_, err = tp.R.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestConnectionLifetimeCountedOnce(t *testing.T) {
+	h := newTestHandler(t, "connections: {disable_keep_alives: true}")
+	handler := h.withConnectionLifetime(http.HandlerFunc(h.echo))
+
+	// Requests multiplexed on the same connection count it once.
+	ctx := connContext(context.Background(), nil)
+	for range 3 {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/echo", nil).WithContext(ctx))
+		require.Equal(t, "close", rec.Header().Get("Connection"))
+	}
+	require.Equal(t, 1.0, testutil.ToFloat64(h.metrics.connectionsClosed.WithLabelValues("keep_alives_disabled")))
+}
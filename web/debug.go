@@ -0,0 +1,150 @@
+package web
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/common/route"
+)
+
+// blockProfileRate mirrors the rate set with runtime.SetBlockProfileRate which
+// cannot be read back from the runtime.
+var blockProfileRate atomic.Int64
+
+var publishRuntimeOnce sync.Once
+
+// SetBlockProfileRate sets the block profile rate of the runtime.
+func SetBlockProfileRate(rate int) {
+	runtime.SetBlockProfileRate(rate)
+	blockProfileRate.Store(int64(rate))
+}
+
+// profileRates contains the sampling rates of the block and mutex profiles.
+type profileRates struct {
+	BlockProfileRate     int `json:"blockProfileRate"`
+	MutexProfileFraction int `json:"mutexProfileFraction"`
+}
+
+func currentProfileRates() profileRates {
+	return profileRates{
+		BlockProfileRate:     int(blockProfileRate.Load()),
+		MutexProfileFraction: runtime.SetMutexProfileFraction(-1),
+	}
+}
+
+// publishRuntime exposes runtime information next to the default memstats and
+// cmdline expvars.
+func publishRuntime() {
+	publishRuntimeOnce.Do(func() {
+		expvar.Publish("runtime", expvar.Func(func() interface{} {
+			return map[string]interface{}{
+				"goroutines": runtime.NumGoroutine(),
+				"gomaxprocs": runtime.GOMAXPROCS(0),
+				"numCPU":     runtime.NumCPU(),
+				"goVersion":  runtime.Version(),
+				"profiles":   currentProfileRates(),
+			}
+		}))
+	})
+}
+
+func (h *Handler) serveDebug(w http.ResponseWriter, req *http.Request) {
+	if !h.options.EnableLifecycle {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Lifecycle API is not enabled."))
+		return
+	}
+
+	ctx := req.Context()
+	subpath := route.Param(ctx, "subpath")
+
+	switch subpath {
+	case "/vars":
+		expvar.Handler().ServeHTTP(w, req)
+		return
+	case "/goroutines":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+		return
+	case "/rates":
+		h.serveProfileRates(w, req)
+		return
+	case "/pprof":
+		http.Redirect(w, req, req.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	if !strings.HasPrefix(subpath, "/pprof/") {
+		http.NotFound(w, req)
+		return
+	}
+
+	subpath = strings.TrimPrefix(subpath, "/pprof/")
+
+	switch subpath {
+	case "cmdline":
+		pprof.Cmdline(w, req)
+	case "profile":
+		pprof.Profile(w, req)
+	case "symbol":
+		pprof.Symbol(w, req)
+	case "trace":
+		pprof.Trace(w, req)
+	default:
+		req.URL.Path = "/debug/pprof/" + subpath
+		pprof.Index(w, req)
+	}
+}
+
+// serveProfileRates returns the block and mutex profile rates and updates
+// them on PUT requests.
+func (h *Handler) serveProfileRates(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		// Validate every rate before applying any of them.
+		params := []struct {
+			name string
+			set  func(int)
+		}{
+			{"block_profile_rate", SetBlockProfileRate},
+			{"mutex_profile_fraction", func(v int) { runtime.SetMutexProfileFraction(v) }},
+		}
+		var updates []func()
+		for _, p := range params {
+			s := req.FormValue(p.name)
+			if s == "" {
+				continue
+			}
+			v, err := strconv.Atoi(s)
+			if err != nil || v < 0 {
+				http.Error(w, fmt.Sprintf("invalid %s %q", p.name, s), http.StatusBadRequest)
+				return
+			}
+			set := p.set
+			updates = append(updates, func() { set(v) })
+		}
+		for _, update := range updates {
+			update()
+		}
+		h.logger.Info("Changed profile rates", "rates", fmt.Sprintf("%+v", currentProfileRates()))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Only GET or PUT requests allowed"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(currentProfileRates()); err != nil {
+		http.Error(w, fmt.Sprintf("error encoding JSON: %s", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,42 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeProfileRates(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	h := New(nil, &Options{
+		Version:         &DemoappVersion{},
+		EnableLifecycle: true,
+		EnableDebug:     true,
+		Gatherer:        reg,
+		Registerer:      reg,
+	})
+	defer SetBlockProfileRate(0)
+	defer runtime.SetMutexProfileFraction(runtime.SetMutexProfileFraction(-1))
+
+	put := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.router.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/debug/rates?"+query, nil))
+		return rec
+	}
+
+	rec := put("block_profile_rate=10&mutex_profile_fraction=5")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var rates profileRates
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rates))
+	require.Equal(t, profileRates{BlockProfileRate: 10, MutexProfileFraction: 5}, rates)
+
+	// No rate is applied if any of them is invalid.
+	rec = put("block_profile_rate=20&mutex_profile_fraction=-1")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Equal(t, profileRates{BlockProfileRate: 10, MutexProfileFraction: 5}, currentProfileRates())
+}
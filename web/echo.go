@@ -0,0 +1,56 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// maxEchoBodySize limits how much of the request body is echoed back.
+const maxEchoBodySize = 1 << 20
+
+type echoResponse struct {
+	Hostname   string      `json:"hostname"`
+	Version    string      `json:"version"`
+	Proto      string      `json:"proto"`
+	TLS        bool        `json:"tls"`
+	Method     string      `json:"method"`
+	Host       string      `json:"host"`
+	URI        string      `json:"uri"`
+	RemoteAddr string      `json:"remoteAddr"`
+	ClientIP   string      `json:"clientIp"`
+	Headers    http.Header `json:"headers"`
+	Body       string      `json:"body,omitempty"`
+}
+
+// echo replies with a description of the received request.
+func (h *Handler) echo(w http.ResponseWriter, r *http.Request) {
+	hostname, _ := os.Hostname()
+	resp := echoResponse{
+		Hostname:   hostname,
+		Version:    h.versionInfo.Version,
+		Proto:      r.Proto,
+		TLS:        r.TLS != nil,
+		Method:     r.Method,
+		Host:       r.Host,
+		URI:        r.RequestURI,
+		RemoteAddr: r.RemoteAddr,
+		ClientIP:   ClientIPFromContext(r.Context()),
+		Headers:    r.Header,
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxEchoBodySize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading body: %s", err), http.StatusBadRequest)
+		return
+	}
+	resp.Body = string(body)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(resp); err != nil {
+		http.Error(w, fmt.Sprintf("error encoding JSON: %s", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,81 @@
+package web
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// H2CMode controls how HTTP/2 over cleartext TCP is negotiated.
+type H2CMode string
+
+const (
+	// H2COff disables h2c, only HTTP/1.x is served on plain listeners.
+	H2COff H2CMode = "off"
+	// H2CPriorKnowledge accepts clients starting with the HTTP/2 connection preface.
+	H2CPriorKnowledge H2CMode = "prior-knowledge"
+	// H2CUpgrade accepts HTTP/1.1 requests carrying an "Upgrade: h2c" header.
+	H2CUpgrade H2CMode = "upgrade"
+	// H2CAll accepts both prior-knowledge and upgrade clients.
+	H2CAll H2CMode = "all"
+)
+
+// H2CModes lists the accepted values of H2CMode.
+var H2CModes = []string{string(H2COff), string(H2CPriorKnowledge), string(H2CUpgrade), string(H2CAll)}
+
+func isPriorKnowledge(r *http.Request) bool {
+	return r.Method == "PRI" && len(r.Header) == 0 && r.URL.Path == "*" && r.Proto == "HTTP/2.0"
+}
+
+func isH2CUpgrade(r *http.Request) bool {
+	for _, v := range r.Header.Values("Upgrade") {
+		if strings.EqualFold(strings.TrimSpace(v), "h2c") {
+			return true
+		}
+	}
+	return false
+}
+
+// withH2C wraps h so that HTTP/2 cleartext connections are served according to
+// the given mode. Requests which ask for a disabled negotiation method fall
+// back to HTTP/1.x, except prior-knowledge prefaces which cannot be answered
+// in HTTP/1.x.
+func withH2C(h http.Handler, mode H2CMode, l *slog.Logger) (http.Handler, error) {
+	var allowPriorKnowledge, allowUpgrade bool
+	switch mode {
+	case H2COff, "":
+		return h, nil
+	case H2CPriorKnowledge:
+		allowPriorKnowledge = true
+	case H2CUpgrade:
+		allowUpgrade = true
+	case H2CAll:
+		allowPriorKnowledge, allowUpgrade = true, true
+	default:
+		return nil, fmt.Errorf("unknown h2c mode %q", mode)
+	}
+
+	h2cHandler := h2c.NewHandler(h, &http2.Server{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case isPriorKnowledge(r):
+			if !allowPriorKnowledge {
+				http.Error(w, "HTTP/2 with prior knowledge is not enabled", http.StatusHTTPVersionNotSupported)
+				return
+			}
+			l.Debug("Serving h2c connection", "negotiation", H2CPriorKnowledge, "client", r.RemoteAddr)
+		case isH2CUpgrade(r):
+			if !allowUpgrade {
+				r.Header.Del("Upgrade")
+				r.Header.Del("HTTP2-Settings")
+				break
+			}
+			l.Debug("Serving h2c connection", "negotiation", H2CUpgrade, "client", r.RemoteAddr)
+		}
+		h2cHandler.ServeHTTP(w, r)
+	}), nil
+}
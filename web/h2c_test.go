@@ -0,0 +1,163 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestH2CModes(t *testing.T) {
+	testCases := []struct {
+		mode                 H2CMode
+		expectPriorKnowledge bool
+	}{
+		{mode: H2COff},
+		{mode: H2CUpgrade},
+		{mode: H2CPriorKnowledge, expectPriorKnowledge: true},
+		{mode: H2CAll, expectPriorKnowledge: true},
+	}
+
+	h := &Handler{versionInfo: &DemoappVersion{}}
+	for _, tc := range testCases {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			handler, err := withH2C(http.HandlerFunc(h.echo), tc.mode, promslog.NewNopLogger())
+			require.NoError(t, err)
+			srv := httptest.NewServer(handler)
+			defer srv.Close()
+
+			// HTTP/1.1 is served in every mode.
+			resp, err := srv.Client().Get(srv.URL + "/echo")
+			require.NoError(t, err)
+			require.Equal(t, "HTTP/1.1", decodeEchoProto(t, resp))
+
+			priorKnowledge := &http.Client{Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, addr)
+				},
+			}}
+			resp, err = priorKnowledge.Get(srv.URL + "/echo")
+			if !tc.expectPriorKnowledge {
+				if err == nil {
+					resp.Body.Close()
+				}
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "HTTP/2.0", decodeEchoProto(t, resp))
+		})
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	testCases := []struct {
+		mode          H2CMode
+		expectUpgrade bool
+	}{
+		{mode: H2COff},
+		{mode: H2CPriorKnowledge},
+		{mode: H2CUpgrade, expectUpgrade: true},
+		{mode: H2CAll, expectUpgrade: true},
+	}
+
+	h := &Handler{versionInfo: &DemoappVersion{}}
+	for _, tc := range testCases {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			handler, err := withH2C(http.HandlerFunc(h.echo), tc.mode, promslog.NewNopLogger())
+			require.NoError(t, err)
+			srv := httptest.NewServer(handler)
+			defer srv.Close()
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			_, err = io.WriteString(conn, "GET /echo HTTP/1.1\r\n"+
+				"Host: demoapp\r\n"+
+				"Connection: Upgrade, HTTP2-Settings\r\n"+
+				"Upgrade: h2c\r\n"+
+				"HTTP2-Settings: AAMAAABkAAQCAAAAAAIAAAAA\r\n"+
+				"\r\n")
+			require.NoError(t, err)
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			require.NoError(t, err)
+
+			if !tc.expectUpgrade {
+				// The request is served in HTTP/1.1 without switching protocols.
+				require.Equal(t, "HTTP/1.1", decodeEchoProto(t, resp))
+				return
+			}
+			require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+			require.Equal(t, "h2c", resp.Header.Get("Upgrade"))
+
+			// The upgraded request is answered in HTTP/2 frames on stream 1
+			// once the client sent its connection preface. The request itself
+			// keeps the protocol version it was sent with.
+			_, err = io.WriteString(conn, http2.ClientPreface)
+			require.NoError(t, err)
+			framer := http2.NewFramer(conn, br)
+			require.NoError(t, framer.WriteSettings())
+
+			var status string
+			var body bytes.Buffer
+			dec := hpack.NewDecoder(4096, func(f hpack.HeaderField) {
+				if f.Name == ":status" {
+					status = f.Value
+				}
+			})
+			for {
+				f, err := framer.ReadFrame()
+				require.NoError(t, err)
+				if f.Header().StreamID != 1 {
+					continue
+				}
+				switch f := f.(type) {
+				case *http2.HeadersFrame:
+					_, err := dec.Write(f.HeaderBlockFragment())
+					require.NoError(t, err)
+				case *http2.DataFrame:
+					body.Write(f.Data())
+				}
+				if f.Header().Flags.Has(http2.FlagDataEndStream) {
+					break
+				}
+			}
+			require.Equal(t, "200", status)
+			var echo echoResponse
+			require.NoError(t, json.Unmarshal(body.Bytes(), &echo))
+			require.Equal(t, "HTTP/1.1", echo.Proto)
+			require.Equal(t, "/echo", echo.URI)
+		})
+	}
+}
+
+func TestH2CUnknownMode(t *testing.T) {
+	_, err := withH2C(http.NotFoundHandler(), "h3", promslog.NewNopLogger())
+	require.Error(t, err)
+}
+
+func decodeEchoProto(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var echo echoResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&echo))
+	return echo.Proto
+}
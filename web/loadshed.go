@@ -0,0 +1,131 @@
+package web
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ilolicon/demoapp/config"
+	api_v1 "github.com/ilolicon/demoapp/web/api/v1"
+)
+
+var errOverloaded = errors.New("server overloaded, retry later")
+
+// loadShedder is an AIMD concurrency limiter.
+type loadShedder struct {
+	config config.LoadSheddingConfig
+	gauge  prometheus.Gauge
+
+	mtx          sync.Mutex
+	limit        float64
+	inflight     int
+	lastDecrease time.Time
+}
+
+// newLoadShedder returns the limiter of cfg, or nil if load shedding is
+// disabled. The current limit is reported in gauge.
+func newLoadShedder(cfg config.LoadSheddingConfig, gauge prometheus.Gauge) *loadShedder {
+	if !cfg.Enabled {
+		gauge.Set(0)
+		return nil
+	}
+	gauge.Set(float64(cfg.InitialLimit))
+	return &loadShedder{
+		config: cfg,
+		gauge:  gauge,
+		limit:  float64(cfg.InitialLimit),
+	}
+}
+
+// acquire counts an in-flight request. Returns false if the limit is reached.
+func (s *loadShedder) acquire() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.inflight >= int(s.limit) {
+		return false
+	}
+	s.inflight++
+	return true
+}
+
+// release adjusts the limit to the latency of a completed request. The limit
+// is decreased at most once per target latency, so that the requests already
+// in flight when the latency rose don't collapse it.
+func (s *loadShedder) release(latency time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	inflight := s.inflight
+	s.inflight--
+
+	target := time.Duration(s.config.TargetLatency)
+	now := time.Now()
+	switch {
+	case latency > target:
+		if now.Sub(s.lastDecrease) < target {
+			return
+		}
+		s.limit = math.Max(float64(s.config.MinLimit), s.limit*s.config.BackoffRatio)
+		s.lastDecrease = now
+	case float64(inflight)*2 >= s.limit:
+		// Only grow the limit when it is actually used.
+		s.limit = math.Min(float64(s.config.MaxLimit), s.limit+1)
+	default:
+		return
+	}
+	s.gauge.Set(math.Floor(s.limit))
+}
+
+// longRunning returns whether the handler is expected to outlast the target
+// latency, e.g. CPU profiles and traces, so that it doesn't drive the limit
+// down.
+func longRunning(handlerName string) bool {
+	return strings.HasPrefix(handlerName, "/debug/")
+}
+
+// withInflightRequests counts the requests being served.
+func (h *Handler) withInflightRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.metrics.inflightRequests.Inc()
+		defer h.metrics.inflightRequests.Dec()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// instrumentLoadShedding answers requests over the adaptive concurrency limit
+// with 503 and the unavailable error type. The lifecycle endpoints, metrics
+// and long-running handlers are never shed.
+func (h *Handler) instrumentLoadShedding(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
+	if exempt(handlerName) || longRunning(handlerName) {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.mtx.RLock()
+		shedder := h.loadShedder
+		h.mtx.RUnlock()
+
+		if shedder == nil {
+			handler(w, r)
+			return
+		}
+		if !shedder.acquire() {
+			h.metrics.shedRequests.Inc()
+			api_v1.RespondError(w, api_v1.ErrUnavailable(errOverloaded))
+			return
+		}
+		start := time.Now()
+		defer func() { shedder.release(time.Since(start)) }()
+		handler(w, r)
+	}
+}
+
+func (h *Handler) instrumentLoadSheddingWithPrefix(prefix string) func(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
+		return h.instrumentLoadShedding(prefix+handlerName, handler)
+	}
+}
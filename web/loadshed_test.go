@@ -0,0 +1,102 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ilolicon/demoapp/config"
+)
+
+func newTestLoadShedder(initialLimit int) *loadShedder {
+	cfg := config.DefaultLoadSheddingConfig
+	cfg.Enabled = true
+	cfg.TargetLatency = model.Duration(100 * time.Millisecond)
+	cfg.InitialLimit = initialLimit
+	cfg.MinLimit = 2
+	cfg.MaxLimit = 5
+	cfg.BackoffRatio = 0.5
+	return newLoadShedder(cfg, prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"}))
+}
+
+func TestLoadShedderAcquire(t *testing.T) {
+	s := newTestLoadShedder(2)
+	require.True(t, s.acquire())
+	require.True(t, s.acquire())
+	require.False(t, s.acquire())
+	s.release(time.Millisecond)
+	require.True(t, s.acquire())
+}
+
+func TestLoadShedderAIMD(t *testing.T) {
+	s := newTestLoadShedder(4)
+
+	// The limit only grows when at least half of it is used.
+	require.True(t, s.acquire())
+	s.release(time.Millisecond)
+	require.Equal(t, 4.0, s.limit)
+
+	for range 2 {
+		require.True(t, s.acquire())
+	}
+	s.release(time.Millisecond)
+	require.Equal(t, 5.0, s.limit)
+	s.release(time.Millisecond)
+	require.Equal(t, 5.0, s.limit, "limit above max_limit")
+	require.Equal(t, 5.0, testutil.ToFloat64(s.gauge))
+
+	// Slow requests halve the limit once per target latency.
+	for range 3 {
+		require.True(t, s.acquire())
+	}
+	s.release(time.Second)
+	require.Equal(t, 2.5, s.limit)
+	require.Equal(t, 2.0, testutil.ToFloat64(s.gauge))
+	s.release(time.Second)
+	require.Equal(t, 2.5, s.limit)
+
+	s.lastDecrease = time.Now().Add(-time.Second)
+	s.release(time.Second)
+	require.Equal(t, 2.0, s.limit, "limit below min_limit")
+}
+
+func TestLoadSheddingInstrumented(t *testing.T) {
+	h := newTestHandler(t, "load_shedding: {enabled: true, initial_limit: 1, min_limit: 1, max_limit: 1}")
+
+	started, unblock := make(chan struct{}), make(chan struct{})
+	h.router.Get("/slow", func(http.ResponseWriter, *http.Request) {
+		close(started)
+		<-unblock
+	})
+	h.router.Get("/debug/slow", func(http.ResponseWriter, *http.Request) {})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+	}()
+	<-started
+
+	// Requests over the limit are shed and counted in the request metrics.
+	rec := httptest.NewRecorder()
+	h.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/echo", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, 1.0, testutil.ToFloat64(h.metrics.requestCounter.WithLabelValues("/echo", "503")))
+	require.Equal(t, 1.0, testutil.ToFloat64(h.metrics.shedRequests))
+
+	// Probes and long-running handlers are not shed.
+	for _, path := range []string{"/-/healthy", "/debug/slow"} {
+		rec = httptest.NewRecorder()
+		h.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, rec.Code, path)
+	}
+
+	close(unblock)
+	<-done
+}
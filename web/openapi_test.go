@@ -0,0 +1,86 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/route"
+	"github.com/stretchr/testify/require"
+)
+
+var routeParam = regexp.MustCompile(`[:*](\w+)`)
+
+// TestOpenAPIRoutes checks that the OpenAPI specification describes exactly
+// the registered routes and methods.
+func TestOpenAPIRoutes(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	h := New(nil, &Options{
+		Version:         &DemoappVersion{},
+		EnableLifecycle: true,
+		EnableDebug:     true,
+		Gatherer:        reg,
+		Registerer:      reg,
+	})
+
+	var paths []string
+	record := func(prefix string) func(string, http.HandlerFunc) http.HandlerFunc {
+		return func(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
+			paths = append(paths, prefix+handlerName)
+			return handler
+		}
+	}
+	router := route.New().WithInstrumentation(record(""))
+	h.registerRoutes(router, router)
+	av1 := route.New().WithInstrumentation(record("/api/v1"))
+	h.apiv1.Register(av1)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", router)
+	mux.Handle("/api/v1/", http.StripPrefix("/api/v1", av1))
+
+	// The methods of a path are listed in the Allow header of the OPTIONS
+	// responses.
+	registered := map[string][]string{}
+	for _, p := range paths {
+		specPath := routeParam.ReplaceAllString(p, "{$1}")
+		if _, ok := registered[specPath]; ok {
+			continue
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, routeParam.ReplaceAllString(p, "x"), nil))
+		var methods []string
+		for _, m := range strings.Split(rec.Header().Get("Allow"), ", ") {
+			if m != http.MethodOptions {
+				methods = append(methods, strings.ToLower(m))
+			}
+		}
+		sort.Strings(methods)
+		registered[specPath] = methods
+	}
+
+	b, err := os.ReadFile("api/v1/openapi.json")
+	require.NoError(t, err)
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(b, &spec))
+
+	documented := map[string][]string{}
+	for p, item := range spec.Paths {
+		var methods []string
+		for m := range item {
+			methods = append(methods, m)
+		}
+		sort.Strings(methods)
+		documented[p] = methods
+	}
+
+	require.Equal(t, documented, registered)
+}
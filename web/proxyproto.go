@@ -0,0 +1,142 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// maxPendingProxyHeaders is the maximum number of connections waiting for
+// their PROXY protocol header. Further connections wait in the kernel backlog.
+const maxPendingProxyHeaders = 1024
+
+// proxyProtocolListener parses PROXY protocol v1 and v2 headers on the
+// connections accepted by the wrapped listener, so that RemoteAddr returns the
+// address of the original client.
+//
+// Headers are read in a goroutine per connection, so that a peer which
+// doesn't send anything doesn't hold up the other connections. Accept only
+// returns connections whose header has been read, or which didn't send one
+// within the header timeout.
+//
+// The header is only honored from peers within the trusted ranges; other
+// peers sending one are disconnected. Peers without an IP address, e.g. on
+// Unix domain sockets, are trusted. Connections without a header are served
+// with the peer address.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted       []netip.Prefix
+	headerTimeout time.Duration
+	ctx           context.Context // Canceled when Close is called.
+	cancel        context.CancelFunc
+
+	startOnce sync.Once
+	pending   chan struct{}
+	conns     chan proxyAcceptResult
+}
+
+type proxyAcceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newProxyProtocolListener(l net.Listener, trusted []netip.Prefix, headerTimeout time.Duration) *proxyProtocolListener {
+	if headerTimeout <= 0 {
+		headerTimeout = proxyproto.DefaultReadHeaderTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &proxyProtocolListener{
+		Listener:      l,
+		trusted:       trusted,
+		headerTimeout: headerTimeout,
+		ctx:           ctx,
+		cancel:        cancel,
+		pending:       make(chan struct{}, maxPendingProxyHeaders),
+		conns:         make(chan proxyAcceptResult),
+	}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	l.startOnce.Do(func() { go l.acceptLoop() })
+	select {
+	case res := <-l.conns:
+		return res.conn, res.err
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// acceptLoop accepts connections until the listener is closed and reads the
+// header of each of them in its own goroutine.
+func (l *proxyProtocolListener) acceptLoop() {
+	for {
+		select {
+		case l.pending <- struct{}{}:
+		case <-l.ctx.Done():
+			return
+		}
+
+		c, err := l.Listener.Accept()
+		if err != nil {
+			<-l.pending
+			select {
+			case l.conns <- proxyAcceptResult{err: err}:
+			case <-l.ctx.Done():
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.readHeader(c)
+	}
+}
+
+// readHeader hands c over to Accept once its header is read, or closes it if
+// the header is invalid or not allowed.
+func (l *proxyProtocolListener) readHeader(c net.Conn) {
+	defer func() { <-l.pending }()
+
+	conn := proxyproto.NewConn(c,
+		proxyproto.WithPolicy(l.policy(c.RemoteAddr())),
+		proxyproto.SetReadHeaderTimeout(l.headerTimeout),
+	)
+	// An empty read only reads the header.
+	if _, err := conn.Read(nil); err != nil {
+		c.Close()
+		return
+	}
+
+	select {
+	case l.conns <- proxyAcceptResult{conn: conn}:
+	case <-l.ctx.Done():
+		c.Close()
+	}
+}
+
+// policy returns whether the peer at upstream may send a header.
+func (l *proxyProtocolListener) policy(upstream net.Addr) proxyproto.Policy {
+	tcpAddr, ok := upstream.(*net.TCPAddr)
+	if !ok {
+		return proxyproto.USE
+	}
+	addr := tcpAddr.AddrPort().Addr().Unmap()
+	for _, p := range l.trusted {
+		if p.Contains(addr) {
+			return proxyproto.USE
+		}
+	}
+	return proxyproto.REJECT
+}
+
+func (l *proxyProtocolListener) Close() error {
+	err := l.Listener.Close()
+	l.cancel()
+	return err
+}
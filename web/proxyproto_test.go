@@ -0,0 +1,129 @@
+package web
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ilolicon/demoapp/util/netconnlimit"
+)
+
+const testProxyHeader = "PROXY TCP4 192.0.2.1 192.0.2.2 1234 80\r\n"
+
+// acceptConns accepts connections on l until it is closed.
+func acceptConns(t *testing.T, l net.Listener) <-chan net.Conn {
+	t.Helper()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	return accepted
+}
+
+// nextConn returns the next accepted connection, or fails the test if none
+// is accepted within timeout.
+func nextConn(t *testing.T, accepted <-chan net.Conn, timeout time.Duration) net.Conn {
+	t.Helper()
+	select {
+	case c := <-accepted:
+		t.Cleanup(func() { c.Close() })
+		return c
+	case <-time.After(timeout):
+		t.Fatal("no connection accepted")
+		return nil
+	}
+}
+
+func newTestProxyProtocolListener(t *testing.T, trusted string, headerTimeout time.Duration) net.Listener {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := newProxyProtocolListener(inner, []netip.Prefix{netip.MustParsePrefix(trusted)}, headerTimeout)
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func dial(t *testing.T, l net.Listener, data string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	if data != "" {
+		_, err = io.WriteString(c, data)
+		require.NoError(t, err)
+	}
+	return c
+}
+
+func TestProxyProtocolListenerIdlePeer(t *testing.T) {
+	l := newTestProxyProtocolListener(t, "127.0.0.0/8", time.Second)
+	accepted := acceptConns(t, l)
+
+	// A peer which doesn't send anything doesn't hold up the others.
+	dial(t, l, "")
+	dial(t, l, testProxyHeader+"hello")
+
+	c := nextConn(t, accepted, 500*time.Millisecond)
+	require.Equal(t, "192.0.2.1:1234", c.RemoteAddr().String())
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(c, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	// The idle peer is served without a header after the timeout.
+	c = nextConn(t, accepted, 2*time.Second)
+	require.Equal(t, "127.0.0.1", c.RemoteAddr().(*net.TCPAddr).IP.String())
+}
+
+func TestProxyProtocolListenerUntrustedPeer(t *testing.T) {
+	l := newTestProxyProtocolListener(t, "10.0.0.0/8", time.Second)
+	accepted := acceptConns(t, l)
+
+	// Untrusted peers sending a header are disconnected.
+	rejected := dial(t, l, testProxyHeader)
+	rejected.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := rejected.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// Untrusted peers without a header are served with their own address.
+	dial(t, l, "hello")
+	c := nextConn(t, accepted, 500*time.Millisecond)
+	require.Equal(t, "127.0.0.1", c.RemoteAddr().(*net.TCPAddr).IP.String())
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
+
+func TestProxyProtocolWithoutTrustedCIDRs(t *testing.T) {
+	h := New(nil, &Options{
+		Version:         &DemoappVersion{},
+		ListenAddresses: []string{"127.0.0.1:0"},
+		ProxyProtocol:   true,
+	})
+	_, err := h.Listeners()
+	require.ErrorContains(t, err, "trusted CIDR")
+	_, err = h.Listener("127.0.0.1:0", netconnlimit.NewSharedSemaphore(0))
+	require.ErrorContains(t, err, "trusted CIDR")
+
+	h = New(nil, &Options{
+		Version:                   &DemoappVersion{},
+		ListenAddresses:           []string{"127.0.0.1:0"},
+		ProxyProtocol:             true,
+		ProxyProtocolTrustedCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	listeners, err := h.Listeners()
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	listeners[0].Close()
+}
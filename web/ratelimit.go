@@ -0,0 +1,238 @@
+package web
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/ilolicon/demoapp/config"
+)
+
+const (
+	// clientLimiterIdle is how long the rate limiter of a client is kept
+	// after its last request.
+	clientLimiterIdle = 10 * time.Minute
+	// maxClientLimiters is the maximum number of clients tracked by the
+	// per-client limit. The least recently seen client is forgotten to track
+	// a new one.
+	maxClientLimiters = 10000
+)
+
+// rateLimiter enforces the rate limits configuration.
+type rateLimiter struct {
+	config config.RateLimitsConfig
+
+	global    *rate.Limiter
+	routes    map[string]*rate.Limiter
+	perClient *config.RateLimit
+
+	mtx        sync.Mutex
+	clients    map[string]*clientLimiter
+	maxClients int
+	lastSweep  time.Time
+}
+
+type clientLimiter struct {
+	*rate.Limiter
+	lastSeen time.Time
+}
+
+func newLimiter(l *config.RateLimit) *rate.Limiter {
+	if l == nil {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(l.Rate), l.Burst)
+}
+
+// newRateLimiter returns the rate limiter of cfg, or nil if no limit is
+// configured.
+func newRateLimiter(cfg config.RateLimitsConfig) *rateLimiter {
+	if cfg.Global == nil && cfg.PerClient == nil && len(cfg.Routes) == 0 {
+		return nil
+	}
+	l := &rateLimiter{
+		config:     cfg,
+		global:     newLimiter(cfg.Global),
+		routes:     map[string]*rate.Limiter{},
+		perClient:  cfg.PerClient,
+		clients:    map[string]*clientLimiter{},
+		maxClients: maxClientLimiters,
+		lastSweep:  time.Now(),
+	}
+	for _, r := range cfg.Routes {
+		l.routes[r.Handler] = newLimiter(&r.RateLimit)
+	}
+	return l
+}
+
+func (l *rateLimiter) client(ip string, now time.Time) *rate.Limiter {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if now.Sub(l.lastSweep) > clientLimiterIdle {
+		l.sweep(now)
+	}
+
+	c, ok := l.clients[ip]
+	if !ok {
+		if len(l.clients) >= l.maxClients {
+			l.sweep(now)
+		}
+		if len(l.clients) >= l.maxClients {
+			l.evictOldest()
+		}
+		c = &clientLimiter{Limiter: newLimiter(l.perClient)}
+		l.clients[ip] = c
+	}
+	c.lastSeen = now
+	return c.Limiter
+}
+
+// sweep forgets the idle clients, it must be called with the lock held.
+func (l *rateLimiter) sweep(now time.Time) {
+	for k, c := range l.clients {
+		if now.Sub(c.lastSeen) > clientLimiterIdle {
+			delete(l.clients, k)
+		}
+	}
+	l.lastSweep = now
+}
+
+// evictOldest forgets the least recently seen client, it must be called with
+// the lock held.
+func (l *rateLimiter) evictOldest() {
+	var (
+		oldest   string
+		lastSeen time.Time
+	)
+	for k, c := range l.clients {
+		if oldest == "" || c.lastSeen.Before(lastSeen) {
+			oldest, lastSeen = k, c.lastSeen
+		}
+	}
+	delete(l.clients, oldest)
+}
+
+// exempt returns whether the global and per-client limits don't apply to the
+// handler, so that probes and scrapes keep working.
+func exempt(handlerName string) bool {
+	return strings.HasPrefix(handlerName, "/-/") || handlerName == "/metrics"
+}
+
+// rateLimitResult describes the most restrictive limit applied to a request.
+type rateLimitResult struct {
+	allowed    bool
+	scope      string
+	limit      int
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+// allow takes a token from every limiter applying to the request, or none of
+// them if any is exhausted.
+func (l *rateLimiter) allow(handlerName, clientIP string) rateLimitResult {
+	now := time.Now()
+
+	type scoped struct {
+		scope   string
+		limiter *rate.Limiter
+	}
+	var limiters []scoped
+	if !exempt(handlerName) {
+		if l.perClient != nil {
+			limiters = append(limiters, scoped{"client", l.client(clientIP, now)})
+		}
+		if l.global != nil {
+			limiters = append(limiters, scoped{"global", l.global})
+		}
+	}
+	if lim, ok := l.routes[handlerName]; ok {
+		limiters = append(limiters, scoped{"route", lim})
+	}
+
+	res := rateLimitResult{allowed: true, remaining: math.MaxInt}
+	reservations := make([]*rate.Reservation, 0, len(limiters))
+	for _, s := range limiters {
+		r := s.limiter.ReserveN(now, 1)
+		if delay := r.DelayFrom(now); !r.OK() || delay > 0 {
+			r.CancelAt(now)
+			for _, prev := range reservations {
+				prev.CancelAt(now)
+			}
+			return rateLimitResult{
+				scope:      s.scope,
+				limit:      s.limiter.Burst(),
+				reset:      delay,
+				retryAfter: delay,
+			}
+		}
+		reservations = append(reservations, r)
+
+		tokens := s.limiter.TokensAt(now)
+		if remaining := int(tokens); remaining < res.remaining {
+			// Time until the bucket is full again.
+			reset := time.Duration((float64(s.limiter.Burst()) - tokens) / float64(s.limiter.Limit()) * float64(time.Second))
+			res.scope, res.limit, res.remaining, res.reset = s.scope, s.limiter.Burst(), remaining, reset
+		}
+	}
+	return res
+}
+
+// setHeaders sets the RateLimit header fields of the IETF draft and the
+// Retry-After header of limited requests.
+func (res rateLimitResult) setHeaders(w http.ResponseWriter) {
+	if res.scope == "" {
+		return
+	}
+	seconds := func(d time.Duration) string {
+		return strconv.Itoa(int(math.Ceil(d.Seconds())))
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(max(res.remaining, 0)))
+	w.Header().Set("RateLimit-Reset", seconds(res.reset))
+	if !res.allowed {
+		w.Header().Set("Retry-After", seconds(res.retryAfter))
+	}
+}
+
+// instrumentRateLimit rejects the requests exceeding the configured rate
+// limits with 429.
+func (h *Handler) instrumentRateLimit(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.mtx.RLock()
+		limiter := h.rateLimiter
+		h.mtx.RUnlock()
+
+		if limiter == nil {
+			handler(w, r)
+			return
+		}
+
+		clientIP := ClientIPFromContext(r.Context())
+		if clientIP == "" {
+			clientIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+		}
+		res := limiter.allow(handlerName, clientIP)
+		res.setHeaders(w)
+		if !res.allowed {
+			h.metrics.rateLimited.WithLabelValues(handlerName, res.scope).Inc()
+			http.Error(w, fmt.Sprintf("rate limit exceeded (%s)", res.scope), http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (h *Handler) instrumentRateLimitWithPrefix(prefix string) func(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
+		return h.instrumentRateLimit(prefix+handlerName, handler)
+	}
+}
@@ -0,0 +1,91 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ilolicon/demoapp/config"
+)
+
+func TestRateLimiterAllowCancelsReservations(t *testing.T) {
+	l := newRateLimiter(config.RateLimitsConfig{
+		Global:    &config.RateLimit{Rate: 0.001, Burst: 1},
+		PerClient: &config.RateLimit{Rate: 0.001, Burst: 5},
+	})
+
+	require.True(t, l.allow("/echo", "192.0.2.1").allowed)
+
+	// The global limit is exhausted: the token taken from the client limit
+	// is given back.
+	res := l.allow("/echo", "192.0.2.1")
+	require.False(t, res.allowed)
+	require.Equal(t, "global", res.scope)
+	require.InDelta(t, 4, l.clients["192.0.2.1"].TokensAt(time.Now()), 0.01)
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	h := newTestHandler(t, "rate_limits: {routes: [{handler: /echo, rate: 1, burst: 2}]}")
+	handler := h.instrumentRateLimit("/echo", func(http.ResponseWriter, *http.Request) {})
+
+	testCases := []struct {
+		code       int
+		remaining  string
+		reset      string
+		retryAfter string
+	}{
+		{code: http.StatusOK, remaining: "1", reset: "1"},
+		{code: http.StatusOK, remaining: "0", reset: "2"},
+		{code: http.StatusTooManyRequests, remaining: "0", reset: "1", retryAfter: "1"},
+	}
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/echo", nil))
+		require.Equal(t, tc.code, rec.Code)
+		require.Equal(t, "2", rec.Header().Get("RateLimit-Limit"))
+		require.Equal(t, tc.remaining, rec.Header().Get("RateLimit-Remaining"))
+		require.Equal(t, tc.reset, rec.Header().Get("RateLimit-Reset"))
+		require.Equal(t, tc.retryAfter, rec.Header().Get("Retry-After"))
+	}
+	require.Equal(t, 1.0, testutil.ToFloat64(h.metrics.rateLimited.WithLabelValues("/echo", "route")))
+}
+
+func TestRateLimitExempt(t *testing.T) {
+	h := newTestHandler(t, "rate_limits: {global: {rate: 0.001, burst: 1}, per_client: {rate: 0.001, burst: 1}}")
+	serve := func(handlerName string) int {
+		rec := httptest.NewRecorder()
+		h.instrumentRateLimit(handlerName, func(http.ResponseWriter, *http.Request) {})(rec, httptest.NewRequest(http.MethodGet, handlerName, nil))
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusOK, serve("/echo"))
+	require.Equal(t, http.StatusTooManyRequests, serve("/echo"))
+
+	// Probes and scrapes are not subject to the global and per-client limits.
+	for _, handlerName := range []string{"/-/healthy", "/-/ready", "/metrics"} {
+		require.Equal(t, http.StatusOK, serve(handlerName), handlerName)
+		require.Equal(t, http.StatusOK, serve(handlerName), handlerName)
+	}
+}
+
+func TestRateLimiterMaxClients(t *testing.T) {
+	l := newRateLimiter(config.RateLimitsConfig{
+		PerClient: &config.RateLimit{Rate: 0.001, Burst: 1},
+	})
+	l.maxClients = 2
+
+	now := time.Now()
+	l.client("192.0.2.1", now)
+	l.client("192.0.2.2", now.Add(time.Second))
+	l.client("192.0.2.1", now.Add(2*time.Second))
+
+	// The least recently seen client is forgotten.
+	l.client("192.0.2.3", now.Add(3*time.Second))
+	require.Len(t, l.clients, 2)
+	require.Contains(t, l.clients, "192.0.2.1")
+	require.Contains(t, l.clients, "192.0.2.3")
+}
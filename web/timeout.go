@@ -0,0 +1,184 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	api_v1 "github.com/ilolicon/demoapp/web/api/v1"
+)
+
+// requestTimeout returns the configured timeout of the handler. The default
+// timeout doesn't apply to the lifecycle, metrics and debug endpoints, since
+// profiles and traces run for the requested duration and stream their output.
+func (h *Handler) requestTimeout(handlerName string) time.Duration {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	if h.config == nil {
+		return 0
+	}
+	for _, r := range h.config.Timeouts.Routes {
+		if r.Handler == handlerName {
+			return time.Duration(r.Timeout)
+		}
+	}
+	if exempt(handlerName) || longRunning(handlerName) {
+		return 0
+	}
+	return time.Duration(h.config.Timeouts.Default)
+}
+
+// respondContextError answers a request whose context is done, with 503 if
+// its deadline was exceeded and 499 if the client went away.
+func respondContextError(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		api_v1.RespondError(w, api_v1.ErrTimeout(errors.New("request timed out")))
+		return
+	}
+	api_v1.RespondError(w, api_v1.ErrCanceled(errors.New("request canceled by the client")))
+}
+
+// instrumentTimeout applies the configured deadline to the request context.
+// The response is buffered so that it can be replaced by a timeout error if
+// the handler doesn't complete in time. Requests canceled by the client before
+// a response was written are answered with 499, so that they are told apart
+// in the metrics and access log.
+//
+// The handler runs in its own goroutine, which isn't stopped when the deadline
+// is exceeded: it keeps running until it returns, and its writes fail with
+// http.ErrHandlerTimeout. Handlers must watch the request context to stop
+// early. A panic of the handler after the deadline is dropped. The buffered
+// writer doesn't implement http.Flusher, so streamed responses are only sent
+// once the handler returns.
+func (h *Handler) instrumentTimeout(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeout := h.requestTimeout(handlerName)
+		if timeout <= 0 {
+			sw := &statusWriter{ResponseWriter: w}
+			handler(sw, r)
+			if !sw.wroteHeader && r.Context().Err() != nil {
+				respondContextError(w, r.Context().Err())
+			}
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{header: make(http.Header)}
+		done := make(chan struct{})
+		panicCh := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicCh <- p
+				}
+			}()
+			handler(tw, r)
+			close(done)
+		}()
+
+		select {
+		case p := <-panicCh:
+			panic(p)
+		case <-done:
+			tw.mtx.Lock()
+			defer tw.mtx.Unlock()
+			if !tw.wroteHeader && ctx.Err() != nil {
+				respondContextError(w, ctx.Err())
+				return
+			}
+			for k, v := range tw.header {
+				w.Header()[k] = v
+			}
+			if tw.code == 0 {
+				tw.code = http.StatusOK
+			}
+			w.WriteHeader(tw.code)
+			w.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			tw.mtx.Lock()
+			defer tw.mtx.Unlock()
+			tw.timedOut = true
+			respondContextError(w, ctx.Err())
+		}
+	}
+}
+
+func (h *Handler) instrumentTimeoutWithPrefix(prefix string) func(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
+		return h.instrumentTimeout(prefix+handlerName, handler)
+	}
+}
+
+// statusWriter records whether the response header was written.
+type statusWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// timeoutWriter buffers the response of a handler running with a deadline.
+type timeoutWriter struct {
+	header http.Header
+
+	mtx         sync.Mutex
+	buf         bytes.Buffer
+	code        int
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !w.wroteHeader {
+		w.writeHeaderLocked(http.StatusOK)
+	}
+	return w.buf.Write(b)
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.timedOut || w.wroteHeader {
+		return
+	}
+	w.writeHeaderLocked(code)
+}
+
+func (w *timeoutWriter) writeHeaderLocked(code int) {
+	w.wroteHeader = true
+	w.code = code
+}
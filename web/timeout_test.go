@@ -0,0 +1,110 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testTimeoutsConfig = "request_timeouts: {default: 50ms, routes: [{handler: /unlimited, timeout: 0s}]}"
+
+func TestRequestTimeout(t *testing.T) {
+	h := newTestHandler(t, testTimeoutsConfig)
+	for handlerName, expected := range map[string]time.Duration{
+		"/echo":            50 * time.Millisecond,
+		"/unlimited":       0,
+		"/-/healthy":       0,
+		"/metrics":         0,
+		"/debug/*subpath":  0,
+		"/api/v1/metadata": 50 * time.Millisecond,
+	} {
+		require.Equal(t, expected, h.requestTimeout(handlerName), handlerName)
+	}
+}
+
+func TestTimeoutBufferedResponse(t *testing.T) {
+	h := newTestHandler(t, testTimeoutsConfig)
+	handler := h.instrumentTimeout("/echo", func(w http.ResponseWriter, _ *http.Request) {
+		_, ok := w.(http.Flusher)
+		require.False(t, ok, "buffered writer must not implement http.Flusher")
+		w.Header().Set("X-Test", "value")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+		w.WriteHeader(http.StatusOK)
+	})
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/echo", nil))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.Equal(t, "value", rec.Header().Get("X-Test"))
+	require.Equal(t, "created", rec.Body.String())
+}
+
+func TestTimeoutPanic(t *testing.T) {
+	h := newTestHandler(t, testTimeoutsConfig)
+	handler := h.instrumentTimeout("/echo", func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	})
+	require.PanicsWithValue(t, "boom", func() {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/echo", nil))
+	})
+}
+
+func TestTimeoutContextErrors(t *testing.T) {
+	h := newTestHandler(t, testTimeoutsConfig)
+
+	testCases := []struct {
+		name        string
+		handlerName string
+		cancel      bool
+		lateWrite   bool
+		code        int
+		errorType   string
+	}{
+		{name: "deadline exceeded", handlerName: "/echo", lateWrite: true, code: http.StatusServiceUnavailable, errorType: "timeout"},
+		{name: "client canceled", handlerName: "/echo", cancel: true, code: 499, errorType: "canceled"},
+		{name: "client canceled without timeout", handlerName: "/unlimited", cancel: true, code: 499, errorType: "canceled"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			writeErr := make(chan error, 1)
+			handler := h.instrumentTimeout(tc.handlerName, func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+				if tc.lateWrite {
+					// Let the timeout response be written first.
+					time.Sleep(10 * time.Millisecond)
+					_, err := w.Write([]byte("late"))
+					writeErr <- err
+				}
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel {
+				cancel()
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+
+			require.Equal(t, tc.code, rec.Code)
+			var resp struct {
+				Status    string `json:"status"`
+				ErrorType string `json:"errorType"`
+			}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			require.Equal(t, "error", resp.Status)
+			require.Equal(t, tc.errorType, resp.ErrorType)
+
+			if tc.lateWrite {
+				// The handler keeps running after the deadline, its writes
+				// fail.
+				require.ErrorIs(t, <-writeErr, http.ErrHandlerTimeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/common/route"
+
+	"github.com/ilolicon/demoapp/config"
+)
+
+// maxDownstreamBodySize limits how much of a downstream response is read.
+const maxDownstreamBodySize = 1 << 20
+
+// hopResult is the response of the topology endpoint. Downstreams which are
+// demoapp instances themselves nest their own hopResult in Response.
+type hopResult struct {
+	Hostname        string             `json:"hostname"`
+	Version         string             `json:"version"`
+	Route           string             `json:"route"`
+	Mode            config.CallMode    `json:"mode,omitempty"`
+	DurationSeconds float64            `json:"durationSeconds"`
+	Downstreams     []downstreamResult `json:"downstreams,omitempty"`
+}
+
+type downstreamResult struct {
+	URL             string          `json:"url"`
+	StatusCode      int             `json:"statusCode,omitempty"`
+	DurationSeconds float64         `json:"durationSeconds"`
+	Error           string          `json:"error,omitempty"`
+	Response        json.RawMessage `json:"response,omitempty"`
+	Body            string          `json:"body,omitempty"`
+}
+
+func (d downstreamResult) failed() bool {
+	return d.Error != "" || d.StatusCode >= http.StatusBadRequest
+}
+
+// topology calls the downstreams configured for the requested route and
+// aggregates their responses.
+func (h *Handler) topology(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	path := route.Param(r.Context(), "path")
+
+	h.mtx.RLock()
+	rc := h.config.Topology.Route(path)
+	h.mtx.RUnlock()
+	if rc == nil {
+		http.Error(w, fmt.Sprintf("no topology route configured for path %q", path), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(rc.Timeout))
+	defer cancel()
+
+	results := make([]downstreamResult, len(rc.Downstreams))
+	switch rc.Mode {
+	case config.CallModeParallel:
+		var wg sync.WaitGroup
+		for i, d := range rc.Downstreams {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i] = h.callDownstream(ctx, d)
+			}()
+		}
+		wg.Wait()
+	default:
+		for i, d := range rc.Downstreams {
+			results[i] = h.callDownstream(ctx, d)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	resp := hopResult{
+		Hostname:        hostname,
+		Version:         h.versionInfo.Version,
+		Route:           rc.Path,
+		Mode:            rc.Mode,
+		DurationSeconds: time.Since(start).Seconds(),
+		Downstreams:     results,
+	}
+
+	code := http.StatusOK
+	for _, res := range results {
+		if res.failed() {
+			code = http.StatusBadGateway
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(resp); err != nil {
+		h.logger.ErrorContext(r.Context(), "error encoding topology response", "route", rc.Path, "err", err)
+	}
+}
+
+func (h *Handler) callDownstream(ctx context.Context, d *config.Downstream) (res downstreamResult) {
+	start := time.Now()
+	res.URL = d.URL
+	defer func() {
+		res.DurationSeconds = time.Since(start).Seconds()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(d.Timeout))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.URL, nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if reqID := middleware.GetReqID(ctx); reqID != "" {
+		req.Header.Set(middleware.RequestIDHeader, reqID)
+	}
+
+	resp, err := h.downstreamClient.Do(req)
+	if err != nil {
+		h.logger.DebugContext(ctx, "Downstream call failed", "url", d.URL, "err", err)
+		res.Error = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+
+	res.StatusCode = resp.StatusCode
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDownstreamBodySize))
+	if err != nil {
+		res.Error = fmt.Sprintf("error reading response body: %s", err)
+		return res
+	}
+	if json.Valid(body) {
+		res.Response = body
+	} else {
+		res.Body = string(body)
+	}
+	return res
+}
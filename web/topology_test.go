@@ -0,0 +1,214 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// newTestTopologyServer serves the handler with the given topology routes as
+// it is served on the web listeners.
+func newTestTopologyServer(t *testing.T, routes string) *httptest.Server {
+	t.Helper()
+	h := newTestHandler(t, "access_log: {enabled: false}\ntopology: {routes: ["+routes+"]}")
+	h.SetReady(Ready)
+	srv, err := h.newServer(h.router)
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.Config.ConnContext = srv.ConnContext
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func getTopology(t *testing.T, ts *httptest.Server, path string, header http.Header) (int, hopResult) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/topology"+path, nil)
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var res hopResult
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusBadGateway {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	}
+	return resp.StatusCode, res
+}
+
+func TestTopologyFanOut(t *testing.T) {
+	// Both downstreams only answer once they were both called, which only
+	// happens in parallel mode.
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	barrier := func(w http.ResponseWriter) bool {
+		arrived.Done()
+		done := make(chan struct{})
+		go func() {
+			arrived.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return true
+		case <-time.After(2 * time.Second):
+			http.Error(w, "not called in parallel", http.StatusInternalServerError)
+			return false
+		}
+	}
+	jsonDownstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if barrier(w) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"hostname":"json"}`)
+		}
+	}))
+	defer jsonDownstream.Close()
+	textDownstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if barrier(w) {
+			fmt.Fprint(w, "plain text")
+		}
+	}))
+	defer textDownstream.Close()
+
+	ts := newTestTopologyServer(t, fmt.Sprintf(
+		"{path: /fanout, mode: parallel, downstreams: [{url: %s}, {url: %s}]}",
+		jsonDownstream.URL, textDownstream.URL,
+	))
+
+	code, res := getTopology(t, ts, "/fanout", nil)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "/fanout", res.Route)
+	require.Len(t, res.Downstreams, 2)
+	require.Equal(t, jsonDownstream.URL, res.Downstreams[0].URL)
+	require.Equal(t, http.StatusOK, res.Downstreams[0].StatusCode)
+	require.JSONEq(t, `{"hostname":"json"}`, string(res.Downstreams[0].Response))
+	require.Equal(t, textDownstream.URL, res.Downstreams[1].URL)
+	require.Equal(t, http.StatusOK, res.Downstreams[1].StatusCode)
+	require.Equal(t, "plain text", res.Downstreams[1].Body)
+
+	code, _ = getTopology(t, ts, "/unknown", nil)
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+func TestTopologyDownstreamTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, "fast")
+	}))
+	defer fast.Close()
+
+	ts := newTestTopologyServer(t, fmt.Sprintf(
+		"{path: /downstream, downstreams: [{url: %[1]s, timeout: 50ms}, {url: %[2]s}]},"+
+			"{path: /route, timeout: 50ms, downstreams: [{url: %[1]s}]}",
+		slow.URL, fast.URL,
+	))
+
+	// A downstream timing out doesn't hold up the next ones.
+	start := time.Now()
+	code, res := getTopology(t, ts, "/downstream", nil)
+	require.Less(t, time.Since(start), 2*time.Second)
+	require.Equal(t, http.StatusBadGateway, code)
+	require.Len(t, res.Downstreams, 2)
+	require.Contains(t, res.Downstreams[0].Error, "context deadline exceeded")
+	require.Zero(t, res.Downstreams[0].StatusCode)
+	require.Equal(t, http.StatusOK, res.Downstreams[1].StatusCode)
+
+	// The route timeout bounds the calls of the whole route.
+	start = time.Now()
+	code, res = getTopology(t, ts, "/route", nil)
+	require.Less(t, time.Since(start), 2*time.Second)
+	require.Equal(t, http.StatusBadGateway, code)
+	require.Contains(t, res.Downstreams[0].Error, "context deadline exceeded")
+}
+
+func TestTopologyDownstreamError(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	ts := newTestTopologyServer(t, fmt.Sprintf(
+		"{path: /status, mode: parallel, downstreams: [{url: %[1]s}, {url: %[2]s}]},"+
+			"{path: /unreachable, downstreams: [{url: %[1]s}, {url: %[3]s}]}",
+		ok.URL, failing.URL, closed.URL,
+	))
+
+	code, res := getTopology(t, ts, "/status", nil)
+	require.Equal(t, http.StatusBadGateway, code)
+	require.Equal(t, http.StatusOK, res.Downstreams[0].StatusCode)
+	require.Equal(t, http.StatusInternalServerError, res.Downstreams[1].StatusCode)
+	require.Equal(t, "boom\n", res.Downstreams[1].Body)
+	require.Empty(t, res.Downstreams[1].Error)
+
+	code, res = getTopology(t, ts, "/unreachable", nil)
+	require.Equal(t, http.StatusBadGateway, code)
+	require.Equal(t, http.StatusOK, res.Downstreams[0].StatusCode)
+	require.Empty(t, res.Downstreams[0].Error)
+	require.Zero(t, res.Downstreams[1].StatusCode)
+	require.Contains(t, res.Downstreams[1].Error, "connection refused")
+}
+
+func TestTopologyTraceHeaders(t *testing.T) {
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	tp := sdktrace.NewTracerProvider()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		tp.Shutdown(context.Background())
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	headers := make(chan http.Header, 1)
+	downstream := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+	}))
+	defer downstream.Close()
+
+	ts := newTestTopologyServer(t, fmt.Sprintf("{path: /trace, downstreams: [{url: %s}]}", downstream.URL))
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	code, _ := getTopology(t, ts, "/trace", http.Header{
+		"Traceparent":              {"00-" + traceID + "-" + spanID + "-01"},
+		middleware.RequestIDHeader: {"req-1"},
+	})
+	require.Equal(t, http.StatusOK, code)
+
+	h := <-headers
+	require.Equal(t, "req-1", h.Get(middleware.RequestIDHeader))
+	// The downstream call is a child of the span of the incoming request.
+	parts := strings.Split(h.Get("Traceparent"), "-")
+	require.Len(t, parts, 4)
+	require.Equal(t, traceID, parts[1])
+	require.NotEqual(t, spanID, parts[2])
+}
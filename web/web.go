@@ -3,11 +3,15 @@ package web
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"reflect"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -21,9 +25,14 @@ import (
 	"github.com/prometheus/common/version"
 	toolkit_web "github.com/prometheus/exporter-toolkit/web"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/ilolicon/demoapp/config"
+	"github.com/ilolicon/demoapp/pkg/chilog"
+	"github.com/ilolicon/demoapp/tracing"
+	"github.com/ilolicon/demoapp/util/clientip"
 	"github.com/ilolicon/demoapp/util/netconnlimit"
+	"github.com/ilolicon/demoapp/util/netlisten"
 	api_v1 "github.com/ilolicon/demoapp/web/api/v1"
 )
 
@@ -46,7 +55,7 @@ func withStackTracer(h http.Handler, l *slog.Logger) http.Handler {
 				const size = 64 << 10
 				buf := make([]byte, size)
 				buf = buf[:runtime.Stack(buf, false)]
-				l.Error("panic while serving request", "client", r.RemoteAddr, "url", r.URL, "err", err, "stack", buf)
+				l.ErrorContext(r.Context(), "panic while serving request", "client", r.RemoteAddr, "url", r.URL, "err", err, "stack", buf)
 				panic(err)
 			}
 		}()
@@ -59,6 +68,13 @@ type metrics struct {
 	requestDuration *prometheus.HistogramVec
 	responseSize    *prometheus.HistogramVec
 	readyStatus     prometheus.Gauge
+	connections     *netconnlimit.Metrics
+
+	connectionsClosed *prometheus.CounterVec
+	rateLimited       *prometheus.CounterVec
+	inflightRequests  prometheus.Gauge
+	concurrencyLimit  prometheus.Gauge
+	shedRequests      prometheus.Counter
 }
 
 func newMetrics(r prometheus.Registerer) *metrics {
@@ -93,11 +109,42 @@ func newMetrics(r prometheus.Registerer) *metrics {
 			Name: "demoapp_ready",
 			Help: "Whether demoapp startup was fully completed and the server is ready for normal operation.",
 		}),
+		connectionsClosed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "demoapp_http_connections_closed_total",
+				Help: "Total number of HTTP connections closed by the server due to the connection lifetime limits.",
+			},
+			[]string{"reason"},
+		),
+	}
+	m.rateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "demoapp_http_rate_limited_total",
+			Help: "Total number of HTTP requests rejected by the rate limits.",
+		},
+		[]string{"handler", "scope"},
+	)
+	m.inflightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "demoapp_http_inflight_requests",
+		Help: "Number of HTTP requests being served on the web listeners.",
+	})
+	m.concurrencyLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "demoapp_http_concurrency_limit",
+		Help: "Current adaptive limit of in-flight HTTP requests, 0 if load shedding is disabled.",
+	})
+	m.shedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "demoapp_http_shed_requests_total",
+		Help: "Total number of HTTP requests rejected by the load shedding.",
+	})
+	for _, reason := range []string{"keep_alives_disabled", "max_requests", "max_age"} {
+		m.connectionsClosed.WithLabelValues(reason)
 	}
 
 	if r != nil {
-		r.MustRegister(m.requestCounter, m.requestDuration, m.responseSize, m.readyStatus)
+		r.MustRegister(m.requestCounter, m.requestDuration, m.responseSize, m.readyStatus, m.connectionsClosed, m.rateLimited,
+			m.inflightRequests, m.concurrencyLimit, m.shedRequests)
 	}
+	m.connections = netconnlimit.NewMetrics(r)
 	return m
 }
 
@@ -110,6 +157,7 @@ func (m *metrics) instrumentHandlerWithPrefix(prefix string) func(handlerName st
 func (m *metrics) instrumentHandler(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
 	handlerLabel := prometheus.Labels{"handler": handlerName}
 	m.requestCounter.WithLabelValues(handlerName, "200")
+	exemplar := promhttp.WithExemplarFromContext(exemplarFromContext)
 	return promhttp.InstrumentHandlerCounter(
 		m.requestCounter.MustCurryWith(handlerLabel),
 		promhttp.InstrumentHandlerDuration(
@@ -118,10 +166,21 @@ func (m *metrics) instrumentHandler(handlerName string, handler http.HandlerFunc
 				m.responseSize.MustCurryWith(handlerLabel),
 				handler,
 			),
+			exemplar,
 		),
+		exemplar,
 	)
 }
 
+// exemplarFromContext returns the trace ID of the sampled span in ctx as
+// exemplar labels.
+func exemplarFromContext(ctx context.Context) prometheus.Labels {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsSampled() {
+		return prometheus.Labels{"trace_id": sc.TraceID().String()}
+	}
+	return nil
+}
+
 type DemoappVersion = api_v1.DemoappVersion
 
 // Options for the web Handler.
@@ -132,10 +191,52 @@ type Options struct {
 	ListenAddresses []string
 	ReadTimeout     time.Duration
 	MaxConnections  int
+
+	// ReadHeaderTimeout, WriteTimeout and IdleTimeout are passed to the
+	// http.Server, 0 keeps its defaults.
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// AdminListenAddresses moves the lifecycle, metrics, status API and
+	// debug endpoints to their own listeners when set. The API requests on
+	// these listeners are neither shed nor rate limited. They can't be
+	// combined with systemd socket activation.
+	AdminListenAddresses []string
+	AdminMaxConnections  int
+	// ListenerSource provides the inherited and systemd activated sockets.
+	// Listeners are created from the listen addresses if it is nil.
+	ListenerSource  *netlisten.Source
+	ShutdownTimeout time.Duration
+
+	// ProxyProtocol enables PROXY protocol parsing on the web listeners.
+	// Headers are only accepted from peers within ProxyProtocolTrustedCIDRs,
+	// which must not be empty.
+	ProxyProtocol              bool
+	ProxyProtocolTrustedCIDRs  []netip.Prefix
+	ProxyProtocolHeaderTimeout time.Duration
+
+	// MaxConnectionsPerIP limits the simultaneous connections of a client
+	// on the web listeners, 0 disables the limit.
+	MaxConnectionsPerIP int
+	// ConnectionAcquireTimeout is the maximum time a connection on the web
+	// listeners waits for a free slot, 0 waits indefinitely.
+	ConnectionAcquireTimeout time.Duration
+	ConnectionRejectMode     netconnlimit.RejectMode
+
 	EnableLifecycle bool
+	// EnableConfigAPI allows replacing the configuration file through the
+	// API.
+	EnableConfigAPI bool
+	EnableDebug     bool
+	H2C             H2CMode
 	AppName         string
+	LogLevels       api_v1.LogLevels
 
-	Gatherer   prometheus.Gatherer
+	// Gatherer provides the metrics served on /metrics and by the API. The
+	// default gatherer is used if it is nil.
+	Gatherer prometheus.Gatherer
+	// Registerer registers the metrics of the handler. They are not
+	// registered if it is nil.
 	Registerer prometheus.Registerer
 }
 
@@ -149,16 +250,35 @@ type Handler struct {
 
 	apiv1 *api_v1.API
 
-	router      *route.Router
-	quitCh      chan struct{}
-	quitOnce    sync.Once
-	reloadCh    chan chan error
-	options     *Options
-	config      *config.Config
-	versionInfo *DemoappVersion
-	flagsMap    map[string]string
+	downstreamClient *http.Client
+
+	router        *route.Router
+	adminRouter   *route.Router
+	quitCh        chan struct{}
+	quitOnce      sync.Once
+	reloadCh      chan chan error
+	configCh      chan ConfigUpdate
+	options       *Options
+	config        *config.Config
+	accessLogger  *chilog.Logger
+	accessLogFile *accessLogFile
+	versionInfo   *DemoappVersion
+	flagsMap      map[string]string
+
+	// clientIPResolver resolves the client address through the trusted proxies.
+	clientIPResolver *clientip.Resolver
+	rateLimiter      *rateLimiter
+	loadShedder      *loadShedder
+	// connections limits the connections of the web listeners, it is resized
+	// on config reload.
+	connections *netconnlimit.Semaphore
+	// reserved are the connection slots kept for priority traffic.
+	reserved *netconnlimit.Reserved
 
 	ready atomic.Uint32 // ready is uint32 rather than boolean to be able to use atomic functions.
+	// readyFailed fails the readiness probe on request, e.g. to drain the
+	// instance, without affecting the other endpoints.
+	readyFailed atomic.Bool
 }
 
 func New(logger *slog.Logger, o *Options) *Handler {
@@ -167,22 +287,39 @@ func New(logger *slog.Logger, o *Options) *Handler {
 	}
 
 	m := newMetrics(o.Registerer)
-	router := route.New().
-		WithInstrumentation(m.instrumentHandler)
+
+	gatherer := o.Gatherer
+	if gatherer == nil {
+		gatherer = prometheus.DefaultGatherer
+	}
 
 	h := &Handler{
 		logger: logger,
 
-		gatherer: o.Gatherer,
+		gatherer: gatherer,
 		metrics:  m,
 
-		router:      router,
+		downstreamClient: &http.Client{
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+		},
+
 		quitCh:      make(chan struct{}),
 		reloadCh:    make(chan chan error),
+		configCh:    make(chan ConfigUpdate),
 		options:     o,
 		versionInfo: o.Version,
 		flagsMap:    o.Flags,
+		connections: netconnlimit.NewSharedSemaphore(o.MaxConnections),
+		reserved:    netconnlimit.NewReserved(),
 	}
+	// The rate limits, load shedding and timeouts are enforced within the
+	// request metrics.
+	router := route.New().
+		WithInstrumentation(h.instrumentTimeout).
+		WithInstrumentation(h.instrumentLoadShedding).
+		WithInstrumentation(h.instrumentRateLimit).
+		WithInstrumentation(m.instrumentHandler)
+	h.router = router
 	h.SetReady(NotReady)
 
 	h.apiv1 = api_v1.NewAPI(
@@ -196,9 +333,30 @@ func New(logger *slog.Logger, o *Options) *Handler {
 		h.testReady,
 		h.runtimeInfo,
 		h.versionInfo,
-		o.Gatherer,
+		h.updateConfig,
+		gatherer,
+		o.LogLevels,
+		o.EnableLifecycle,
+		o.EnableConfigAPI,
 	)
 
+	// Administrative endpoints move to their own router when a dedicated
+	// admin listener is configured.
+	adminRouter := router
+	if len(o.AdminListenAddresses) > 0 {
+		adminRouter = route.New().
+			WithInstrumentation(m.instrumentHandler)
+	}
+	h.adminRouter = adminRouter
+
+	h.registerRoutes(router, adminRouter)
+
+	return h
+}
+
+// registerRoutes registers the endpoints outside of the v1 API. The routes
+// are described in the OpenAPI specification of the API, keep them in sync.
+func (h *Handler) registerRoutes(router, adminRouter *route.Router) {
 	readyf := h.testReady
 
 	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
@@ -207,66 +365,197 @@ func New(logger *slog.Logger, o *Options) *Handler {
 	})
 
 	router.Get("/version", h.version)
-	router.Get("/metrics", promhttp.Handler().ServeHTTP)
-
-	if o.EnableLifecycle {
-		router.Post("/-/quit", h.quit)
-		router.Put("/-/quit", h.quit)
-		router.Post("/-/reload", h.reload)
-		router.Put("/-/reload", h.reload)
+	router.Get("/echo", h.echo)
+	router.Post("/echo", h.echo)
+	router.Put("/echo", h.echo)
+	router.Get("/topology/*path", readyf(h.topology))
+
+	var metricsHandler http.Handler = promhttp.HandlerFor(h.gatherer, promhttp.HandlerOpts{
+		Registry:          h.options.Registerer,
+		EnableOpenMetrics: true,
+	})
+	if h.options.Registerer != nil {
+		metricsHandler = promhttp.InstrumentMetricHandler(h.options.Registerer, metricsHandler)
+	}
+	adminRouter.Get("/metrics", metricsHandler.ServeHTTP)
+
+	if h.options.EnableLifecycle {
+		adminRouter.Post("/-/quit", h.quit)
+		adminRouter.Put("/-/quit", h.quit)
+		adminRouter.Post("/-/reload", h.reload)
+		adminRouter.Put("/-/reload", h.reload)
+		adminRouter.Post("/-/ready/fail", h.failReady)
+		adminRouter.Put("/-/ready/fail", h.failReady)
+		adminRouter.Post("/-/ready/restore", h.restoreReady)
+		adminRouter.Put("/-/ready/restore", h.restoreReady)
 	} else {
 		forbiddenAPINotEnabled := func(w http.ResponseWriter, _ *http.Request) {
 			w.WriteHeader(http.StatusForbidden)
 			w.Write([]byte("Lifecycle API is not enabled."))
 		}
-		router.Post("/-/quit", forbiddenAPINotEnabled)
-		router.Put("/-/quit", forbiddenAPINotEnabled)
-		router.Post("/-/reload", forbiddenAPINotEnabled)
-		router.Put("/-/reload", forbiddenAPINotEnabled)
+		adminRouter.Post("/-/quit", forbiddenAPINotEnabled)
+		adminRouter.Put("/-/quit", forbiddenAPINotEnabled)
+		adminRouter.Post("/-/reload", forbiddenAPINotEnabled)
+		adminRouter.Put("/-/reload", forbiddenAPINotEnabled)
+		adminRouter.Post("/-/ready/fail", forbiddenAPINotEnabled)
+		adminRouter.Put("/-/ready/fail", forbiddenAPINotEnabled)
+		adminRouter.Post("/-/ready/restore", forbiddenAPINotEnabled)
+		adminRouter.Put("/-/ready/restore", forbiddenAPINotEnabled)
 	}
-	router.Get("/-/quit", func(w http.ResponseWriter, _ *http.Request) {
+	if h.options.EnableDebug {
+		publishRuntime()
+		adminRouter.Get("/debug/*subpath", h.serveDebug)
+		adminRouter.Post("/debug/*subpath", h.serveDebug)
+		adminRouter.Put("/debug/*subpath", h.serveDebug)
+	}
+
+	adminRouter.Get("/-/quit", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		w.Write([]byte("Only POST or PUT requests allowed"))
 	})
-	router.Get("/-/reload", func(w http.ResponseWriter, _ *http.Request) {
+	adminRouter.Get("/-/reload", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		w.Write([]byte("Only POST or PUT requests allowed"))
 	})
 
+	if adminRouter != router {
+		h.registerProbes(router)
+	}
+	h.registerProbes(adminRouter)
+}
+
+// registerProbes registers the health and readiness endpoints.
+func (h *Handler) registerProbes(router *route.Router) {
+	appName := h.options.AppName
 	router.Get("/-/healthy", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "%s is Healthy.\n", o.AppName)
+		fmt.Fprintf(w, "%s is Healthy.\n", appName)
 	})
 	router.Head("/-/healthy", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
-	router.Get("/-/ready", readyf(func(w http.ResponseWriter, _ *http.Request) {
+	router.Get("/-/ready", h.testProbeReady(func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "%s is Ready.\n", o.AppName)
+		fmt.Fprintf(w, "%s is Ready.\n", appName)
 	}))
-	router.Head("/-/ready", readyf(func(w http.ResponseWriter, _ *http.Request) {
+	router.Head("/-/ready", h.testProbeReady(func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}))
-
-	return h
 }
 
 // ApplyConfig updates the config field of the Handler struct.
 func (h *Handler) ApplyConfig(conf *config.Config) error {
+	clientIPResolver, err := clientip.NewResolver(conf.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	reserved := conf.Connections.Reserved
+	reservedCIDRs, err := clientip.ParsePrefixes(reserved.SourceCIDRs)
+	if err != nil {
+		return err
+	}
+
+	var (
+		accessLogger *chilog.Logger
+		out          io.Writer = os.Stderr
+		file                   = h.accessLogFile
+	)
+	if conf.AccessLog.Enabled && conf.AccessLog.File != "" {
+		if file == nil || !file.reusable(conf.AccessLog) {
+			if file, err = newAccessLogFile(conf.AccessLog, h.logger); err != nil {
+				return err
+			}
+		}
+		out = file
+	} else {
+		file = nil
+	}
+	if conf.AccessLog.Enabled {
+		accessLogger, err = chilog.New(out, chilog.Format(conf.AccessLog.Format), tracing.NewLogHandler)
+		if err != nil {
+			if file != nil && file != h.accessLogFile {
+				file.Close()
+			}
+			return err
+		}
+		accessLogger.SuccessSampling = uint64(conf.AccessLog.SuccessSampling)
+		accessLogger.ClientIP = func(r *http.Request) string {
+			return ClientIPFromContext(r.Context())
+		}
+	}
+
 	h.mtx.Lock()
 	defer h.mtx.Unlock()
 
+	if h.accessLogFile != nil && h.accessLogFile != file {
+		h.accessLogFile.retire()
+	}
 	h.config = conf
+	h.accessLogger = accessLogger
+	h.accessLogFile = file
+	h.clientIPResolver = clientIPResolver
+
+	maxConnections := conf.Connections.MaxConnections
+	if maxConnections == 0 {
+		maxConnections = h.options.MaxConnections
+	}
+	if size := h.connections.Size(); size != maxConnections {
+		h.logger.Info("Updating the connection limit", "previous", size, "max_connections", maxConnections)
+		h.connections.Resize(maxConnections)
+	}
+	h.reserved.Update(reserved.Slots, reservedCIDRs, reserved.Ports, reserved.Paths)
+
+	// Keep the token buckets if the limits didn't change.
+	if h.rateLimiter == nil || !reflect.DeepEqual(h.rateLimiter.config, conf.RateLimits) {
+		h.rateLimiter = newRateLimiter(conf.RateLimits)
+	}
+	if h.loadShedder == nil || h.loadShedder.config != conf.LoadShedding {
+		h.loadShedder = newLoadShedder(conf.LoadShedding, h.metrics.concurrencyLimit)
+	}
 	return nil
 }
 
 // https://github.com/prometheus/prometheus/issues/9105
-// Listeners creates the TCP listeners for web requests.
+// Listeners creates the TCP or Unix domain socket listeners for web requests.
 func (h *Handler) Listeners() ([]net.Listener, error) {
+	return h.listeners(h.options.ListenAddresses, "http", h.connections)
+}
+
+// AdminListeners creates the listeners for the administrative endpoints.
+// It returns no listeners if no admin listen address is configured. Admin
+// listen addresses can't be combined with systemd socket activation, which
+// provides the web listeners only.
+func (h *Handler) AdminListeners() ([]net.Listener, error) {
+	if src := h.options.ListenerSource; src != nil && src.SystemdEnabled() && len(h.options.AdminListenAddresses) > 0 {
+		return nil, errors.New("admin listen addresses are not supported with systemd socket activation")
+	}
+	return h.listeners(h.options.AdminListenAddresses, "admin", netconnlimit.NewSharedSemaphore(h.options.AdminMaxConnections))
+}
+
+func (h *Handler) listeners(addresses []string, name string, sem *netconnlimit.Semaphore) ([]net.Listener, error) {
+	if name == "http" {
+		if err := h.checkProxyProtocol(); err != nil {
+			return nil, err
+		}
+	}
+
 	var listeners []net.Listener
-	sem := netconnlimit.NewSharedSemaphore(h.options.MaxConnections)
-	for _, address := range h.options.ListenAddresses {
-		listener, err := h.Listener(address, sem)
+
+	src := h.options.ListenerSource
+	if name == "http" && src != nil && src.SystemdEnabled() {
+		h.logger.Info("Listening on systemd activated listeners instead of port listeners.")
+		activated, err := src.Systemd()
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range activated {
+			listeners = append(listeners, h.limitListener(l, name, sem))
+		}
+		return listeners, nil
+	}
+
+	for _, address := range addresses {
+		listener, err := h.listener(address, name, sem)
 		if err != nil {
 			return listeners, err
 		}
@@ -275,71 +564,173 @@ func (h *Handler) Listeners() ([]net.Listener, error) {
 	return listeners, nil
 }
 
-// Listener creates the TCP listener for web requests.
-func (h *Handler) Listener(address string, sem chan struct{}) (net.Listener, error) {
-	h.logger.Info("Start listening for connections", "address", address)
+// Listener creates the TCP or Unix domain socket listener for web requests.
+func (h *Handler) Listener(address string, sem *netconnlimit.Semaphore) (net.Listener, error) {
+	if err := h.checkProxyProtocol(); err != nil {
+		return nil, err
+	}
+	return h.listener(address, "http", sem)
+}
+
+// checkProxyProtocol rejects PROXY protocol without trusted peers, which
+// would close every connection sending a header.
+func (h *Handler) checkProxyProtocol() error {
+	if h.options.ProxyProtocol && len(h.options.ProxyProtocolTrustedCIDRs) == 0 {
+		return errors.New("PROXY protocol requires at least one trusted CIDR")
+	}
+	return nil
+}
+
+func (h *Handler) listener(address, name string, sem *netconnlimit.Semaphore) (net.Listener, error) {
+	h.logger.Info("Start listening for connections", "address", address, "listener", name)
 
-	listener, err := net.Listen("tcp", address)
+	var (
+		listener net.Listener
+		err      error
+	)
+	if h.options.ListenerSource != nil {
+		listener, err = h.options.ListenerSource.Listen(address)
+	} else {
+		listener, err = netlisten.Listen(address)
+	}
 	if err != nil {
 		return listener, err
 	}
-	listener = netconnlimit.SharedLimitListener(listener, sem)
+	return h.limitListener(listener, name, sem), nil
+}
+
+// limitListener limits the connections accepted by listener with the shared
+// semaphore and tracks them with conntrack. PROXY protocol headers are parsed
+// on the web listeners if enabled.
+func (h *Handler) limitListener(listener net.Listener, name string, sem *netconnlimit.Semaphore) net.Listener {
+	if name == "http" && h.options.ProxyProtocol {
+		listener = newProxyProtocolListener(listener, h.options.ProxyProtocolTrustedCIDRs, h.options.ProxyProtocolHeaderTimeout)
+	}
+	opts := []netconnlimit.Option{netconnlimit.WithMetrics(h.metrics.connections, name)}
+	if name == "http" {
+		opts = append(opts,
+			netconnlimit.WithMaxPerIP(h.options.MaxConnectionsPerIP),
+			netconnlimit.WithAcquireTimeout(h.options.ConnectionAcquireTimeout),
+			netconnlimit.WithRejectMode(h.options.ConnectionRejectMode),
+			netconnlimit.WithReserved(h.reserved),
+		)
+	}
+	listener = netconnlimit.SharedLimitListener(listener, sem, opts...)
 
 	// Monitor incoming connections with conntrack.
-	listener = conntrack.NewListener(listener,
-		conntrack.TrackWithName("http"),
+	return conntrack.NewListener(listener,
+		conntrack.TrackWithName(name),
 		conntrack.TrackWithTracing())
-
-	return listener, nil
 }
 
-// Run serves the HTTP endpoints.
-func (h *Handler) Run(ctx context.Context, listeners []net.Listener, webConfig string) error {
+// Run serves the HTTP endpoints. The administrative endpoints are served on
+// adminListeners with their own web configuration if admin listen addresses
+// are configured.
+func (h *Handler) Run(ctx context.Context, listeners, adminListeners []net.Listener, webConfig, adminWebConfig string) error {
+	var err error
 	if len(listeners) == 0 {
-		var err error
 		listeners, err = h.Listeners()
 		if err != nil {
 			return err
 		}
 	}
+	if len(adminListeners) == 0 {
+		adminListeners, err = h.AdminListeners()
+		if err != nil {
+			return err
+		}
+	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/", h.router)
 
+	adminMux := mux
+	if h.adminRouter != h.router {
+		adminMux = http.NewServeMux()
+		adminMux.Handle("/", h.adminRouter)
+	}
+
 	apiPath := "/api"
 	av1 := route.New().
+		WithInstrumentation(h.instrumentTimeoutWithPrefix("/api/v1"))
+	if adminMux == mux {
+		// Requests on the admin listener are neither shed nor rate limited.
+		av1 = av1.
+			WithInstrumentation(h.instrumentLoadSheddingWithPrefix("/api/v1")).
+			WithInstrumentation(h.instrumentRateLimitWithPrefix("/api/v1"))
+	}
+	av1 = av1.
 		WithInstrumentation(h.metrics.instrumentHandlerWithPrefix("/api/v1")).
 		WithInstrumentation(setPathWithPrefix(apiPath + "/v1"))
 	h.apiv1.Register(av1)
 
-	mux.Handle(apiPath+"/v1/", http.StripPrefix(apiPath+"/v1", av1))
-
-	errlog := slog.NewLogLogger(h.logger.Handler(), slog.LevelError)
-
-	spanNameFormatter := otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
-		return fmt.Sprintf("%s %s", r.Method, r.URL.Path)
-	})
+	adminMux.Handle(apiPath+"/v1/", http.StripPrefix(apiPath+"/v1", av1))
 
-	httpSrv := &http.Server{
-		Handler:     withStackTracer(otelhttp.NewHandler(mux, "", spanNameFormatter), h.logger),
-		ErrorLog:    errlog,
-		ReadTimeout: h.options.ReadTimeout,
+	httpSrv, err := h.newServer(h.withInflightRequests(mux))
+	if err != nil {
+		return err
 	}
+	servers := []*http.Server{httpSrv}
 
-	errCh := make(chan error, 1)
+	errCh := make(chan error, 2)
 	go func() {
 		errCh <- toolkit_web.ServeMultiple(listeners, httpSrv, &toolkit_web.FlagConfig{WebConfigFile: &webConfig}, h.logger)
 	}()
 
+	if adminMux != mux {
+		adminSrv, err := h.newServer(adminMux)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, adminSrv)
+
+		go func() {
+			errCh <- toolkit_web.ServeMultiple(adminListeners, adminSrv, &toolkit_web.FlagConfig{WebConfigFile: &adminWebConfig}, h.logger.With("listener", "admin"))
+		}()
+	}
+
 	select {
 	case e := <-errCh:
 		return e
 	case <-ctx.Done():
-		httpSrv.Shutdown(ctx)
+		// Let in-flight requests complete, e.g. when handing the listeners
+		// over to a new process.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), h.options.ShutdownTimeout)
+		defer cancel()
+		for _, srv := range servers {
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				h.logger.Warn("Error shutting down web server", "err", err)
+			}
+		}
 		return nil
 	}
 }
 
+// newServer returns the HTTP server serving the given mux.
+func (h *Handler) newServer(mux http.Handler) (*http.Server, error) {
+	errlog := slog.NewLogLogger(h.logger.Handler(), slog.LevelError)
+
+	spanNameFormatter := otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return fmt.Sprintf("%s %s", r.Method, r.URL.Path)
+	})
+
+	handler := otelhttp.NewHandler(withRequestID(h.withClientIP(h.withAccessLog(mux))), "", spanNameFormatter)
+	handler, err := withH2C(withStackTracer(h.withConnectionLifetime(handler), h.logger), h.options.H2C, h.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Server{
+		Handler:           handler,
+		ErrorLog:          errlog,
+		ReadTimeout:       h.options.ReadTimeout,
+		ReadHeaderTimeout: h.options.ReadHeaderTimeout,
+		WriteTimeout:      h.options.WriteTimeout,
+		IdleTimeout:       h.options.IdleTimeout,
+		ConnContext:       connContext,
+	}, nil
+}
+
 func (h *Handler) runtimeInfo() (api_v1.RuntimeInfo, error) {
 	status := api_v1.RuntimeInfo{
 		GoroutineCount: runtime.NumGoroutine(),
@@ -402,6 +793,36 @@ func (h *Handler) Reload() <-chan chan error {
 	return h.reloadCh
 }
 
+// ConfigUpdate is a request to replace the configuration file. The result of
+// the update is sent on Err.
+type ConfigUpdate struct {
+	Content []byte
+	Err     chan error
+}
+
+// ConfigUpdates returns the receive-only channel of the configuration file
+// replacement requests.
+func (h *Handler) ConfigUpdates() <-chan ConfigUpdate {
+	return h.configCh
+}
+
+// updateConfig requests the configuration file to be replaced by content and
+// waits for the result.
+func (h *Handler) updateConfig(ctx context.Context, content []byte) error {
+	u := ConfigUpdate{Content: content, Err: make(chan error, 1)}
+	select {
+	case h.configCh <- u:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-u.Err:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (h *Handler) version(w http.ResponseWriter, _ *http.Request) {
 	dec := json.NewEncoder(w)
 	if err := dec.Encode(h.versionInfo); err != nil {
@@ -429,6 +850,32 @@ func (h *Handler) reload(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
+func (h *Handler) failReady(w http.ResponseWriter, _ *http.Request) {
+	h.readyFailed.Store(true)
+	h.logger.Warn("Readiness probe failed on request")
+	fmt.Fprintf(w, "Readiness probe failed.")
+}
+
+func (h *Handler) restoreReady(w http.ResponseWriter, _ *http.Request) {
+	h.readyFailed.Store(false)
+	h.logger.Info("Readiness probe restored on request")
+	fmt.Fprintf(w, "Readiness probe restored.")
+}
+
+// testProbeReady is testReady for the readiness probe, which is also failed
+// on request.
+func (h *Handler) testProbeReady(f http.HandlerFunc) http.HandlerFunc {
+	return h.testReady(func(w http.ResponseWriter, r *http.Request) {
+		if h.readyFailed.Load() {
+			w.Header().Set("X-Demoapp-Stopping", "false")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Service Unavailable")
+			return
+		}
+		f(w, r)
+	})
+}
+
 type pathParam struct{}
 
 // ContextWithPath returns a new context with the given path to be used later
@@ -437,6 +884,21 @@ func ContextWithPath(ctx context.Context, path string) context.Context {
 	return context.WithValue(ctx, pathParam{}, path)
 }
 
+type clientIPParam struct{}
+
+// ContextWithClientIP returns a new context with the resolved address of the
+// client which sent the request.
+func ContextWithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPParam{}, ip)
+}
+
+// ClientIPFromContext returns the client address stored in ctx, or an empty
+// string if it isn't set.
+func ClientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPParam{}).(string)
+	return ip
+}
+
 func setPathWithPrefix(prefix string) func(handlerName string, handler http.HandlerFunc) http.HandlerFunc {
 	return func(_ string, handler http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,119 @@
+package web
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ilolicon/demoapp/config"
+	"github.com/ilolicon/demoapp/util/netlisten"
+)
+
+func TestNewWithoutRegistry(t *testing.T) {
+	h := New(nil, &Options{Version: &DemoappVersion{}})
+
+	rec := httptest.NewRecorder()
+	h.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "go_goroutines")
+}
+
+func TestAdminListener(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	h := New(nil, &Options{
+		Version:              &DemoappVersion{},
+		AdminListenAddresses: []string{"127.0.0.1:0"},
+		EnableLifecycle:      true,
+		EnableDebug:          true,
+		AppName:              "demoapp",
+		Gatherer:             reg,
+		Registerer:           reg,
+	})
+	// A single request per client and second is allowed on the web listener.
+	conf, err := config.Load("access_log: {enabled: false}\nrate_limits: {per_client: {rate: 1, burst: 1}}")
+	require.NoError(t, err)
+	require.NoError(t, h.ApplyConfig(conf))
+	h.SetReady(Ready)
+
+	listen := func() (net.Listener, string) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		return l, "http://" + l.Addr().String()
+	}
+	l, webURL := listen()
+	adminL, adminURL := listen()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- h.Run(ctx, []net.Listener{l}, []net.Listener{adminL}, "", "")
+	}()
+	defer func() {
+		cancel()
+		require.NoError(t, <-errCh)
+	}()
+
+	resetRateLimits := func() {
+		h.mtx.Lock()
+		h.rateLimiter = newRateLimiter(conf.RateLimits)
+		h.mtx.Unlock()
+	}
+	do := func(method, url string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, url, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		web, admin   int
+	}{
+		{method: http.MethodGet, path: "/metrics", web: http.StatusNotFound, admin: http.StatusOK},
+		{method: http.MethodGet, path: "/-/reload", web: http.StatusNotFound, admin: http.StatusMethodNotAllowed},
+		{method: http.MethodGet, path: "/-/quit", web: http.StatusNotFound, admin: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, path: "/-/ready/fail", web: http.StatusNotFound, admin: http.StatusOK},
+		{method: http.MethodPost, path: "/-/ready/restore", web: http.StatusNotFound, admin: http.StatusOK},
+		{method: http.MethodGet, path: "/api/v1/status/buildinfo", web: http.StatusNotFound, admin: http.StatusOK},
+		{method: http.MethodGet, path: "/api/v1/status/config", web: http.StatusNotFound, admin: http.StatusOK},
+		{method: http.MethodGet, path: "/debug/pprof/", web: http.StatusNotFound, admin: http.StatusOK},
+		{method: http.MethodGet, path: "/debug/vars", web: http.StatusNotFound, admin: http.StatusOK},
+		// The probes are served on both listeners, the application on the web
+		// listeners only.
+		{method: http.MethodGet, path: "/-/healthy", web: http.StatusOK, admin: http.StatusOK},
+		{method: http.MethodGet, path: "/-/ready", web: http.StatusOK, admin: http.StatusOK},
+		{method: http.MethodGet, path: "/echo", web: http.StatusOK, admin: http.StatusNotFound},
+	} {
+		resetRateLimits()
+		require.Equal(t, tc.web, do(tc.method, webURL+tc.path), "web %s %s", tc.method, tc.path)
+		require.Equal(t, tc.admin, do(tc.method, adminURL+tc.path), "admin %s %s", tc.method, tc.path)
+	}
+
+	// The API requests on the admin listener are not rate limited.
+	resetRateLimits()
+	require.Equal(t, http.StatusOK, do(http.MethodGet, webURL+"/echo"))
+	require.Equal(t, http.StatusTooManyRequests, do(http.MethodGet, webURL+"/echo"))
+	for range 3 {
+		require.Equal(t, http.StatusOK, do(http.MethodGet, adminURL+"/api/v1/status/buildinfo"))
+	}
+}
+
+func TestAdminListenerSystemd(t *testing.T) {
+	src, err := netlisten.NewSource(true)
+	require.NoError(t, err)
+	h := New(nil, &Options{
+		Version:              &DemoappVersion{},
+		AdminListenAddresses: []string{"127.0.0.1:0"},
+		ListenerSource:       src,
+	})
+	_, err = h.AdminListeners()
+	require.ErrorContains(t, err, "systemd socket activation")
+}